@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Cache stores rendered output on disk. Entries are always encrypted, the
+// encryption key is derived from a secret (eg. the loaded private keys) and
+// the cache key, so entries can only be read with the same key material.
+type Cache struct {
+	Dir string
+}
+
+// New creates the cache directory (if it does not exist)
+func New(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Get returns the entry for the key, false if there is no (readable) entry
+func (c *Cache) Get(key string, secret []byte) ([]byte, bool, error) {
+	data, err := os.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	gcm, err := aead(key, secret)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, false, nil
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(key))
+	if err != nil {
+		// Corrupted or written with different key material
+		return nil, false, nil
+	}
+	return plain, true, nil
+}
+
+// Put stores the encrypted entry for the key
+func (c *Cache) Put(key string, secret []byte, data []byte) error {
+	gcm, err := aead(key, secret)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := gcm.Seal(nonce, nonce, data, []byte(key))
+
+	// Write to a temporary file first, concurrent renders may read the entry
+	tmp, err := os.CreateTemp(c.Dir, ".entry-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+func aead(key string, secret []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("subst-cache-encryption\x00"))
+	h.Write(secret)
+	h.Write([]byte(key))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Hash builds a cache key from the inputs of a render
+type Hash struct {
+	h hash.Hash
+}
+
+func NewHash() *Hash {
+	return &Hash{h: sha256.New()}
+}
+
+// Add adds a labeled value, the label separates the inputs
+func (h *Hash) Add(label string, value []byte) {
+	fmt.Fprintf(h.h, "%s:%d:", label, len(value))
+	h.h.Write(value)
+}
+
+// AddFiles adds all files within the directory (not recursive)
+func (h *Hash) AddFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		h.Add("file "+path, content)
+	}
+	return nil
+}
+
+// AddTree adds all files within the directory and its subdirectories
+func (h *Hash) AddTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		h.Add("file "+path, content)
+		return nil
+	})
+}
+
+// AddMap adds the entries of a map, sorted by key
+func (h *Hash) AddMap(label string, values map[string]interface{}) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Add(label+" "+k, []byte(fmt.Sprint(values[k])))
+	}
+}
+
+// Sum returns the cache key
+func (h *Hash) Sum() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	c, err := New(filepath.Join(t.TempDir(), "cache"))
+	assert.NoError(t, err)
+
+	data := []byte("apiVersion: v1\nkind: Secret\nstringData:\n  password: s3cr3t\n")
+	assert.NoError(t, c.Put("entry", []byte("secret"), data))
+
+	cached, hit, err := c.Get("entry", []byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, hit)
+	assert.Equal(t, data, cached)
+
+	// Entries are not readable with other key material
+	_, hit, err = c.Get("entry", []byte("other"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+
+	_, hit, err = c.Get("missing", []byte("secret"))
+	assert.NoError(t, err)
+	assert.False(t, hit)
+
+	// Decrypted values are never written in plain text
+	entries, err := os.ReadDir(c.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	raw, err := os.ReadFile(filepath.Join(c.Dir, entries[0].Name()))
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("s3cr3t")))
+}
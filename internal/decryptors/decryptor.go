@@ -2,13 +2,32 @@ package decryptors
 
 import (
 	"context"
+	"io"
+	"time"
 
-	"k8s.io/client-go/kubernetes"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 type DecryptorConfig struct {
 	// Decryption is skipped, but decryption metadata is removed
 	SkipDecrypt bool
+	// Context of the build, external processes (eg. of the exec decryptor)
+	// are stopped once it is done (never if nil)
+	Context context.Context
+	// Timeout of a single call of an external process (default of the
+	// decryptor if 0)
+	Timeout time.Duration
+	// Logger of the decryptor, the global logger if nil
+	Logger *zerolog.Logger
+}
+
+// Log returns the logger of the decryptor
+func (c DecryptorConfig) Log() *zerolog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return &log.Logger
 }
 
 type Decryptor interface {
@@ -16,6 +35,19 @@ type Decryptor interface {
 	IsEncrypted(data []byte) (bool, error)
 	// Reads the given content, based on the decrypter config attempts to decrypt
 	Decrypt(data []byte) (content map[string]interface{}, err error)
-	// Read Private Keys from kubernetes secret
-	KeysFromSecret(secretName string, namespace string, client *kubernetes.Clientset, ctx context.Context) (err error)
+	// Load Private Keys from key material read from a KeySource. Keys which
+	// do not belong to the decryptor are ignored
+	LoadKeys(keys []Key) (err error)
+	// Removes the loaded key material from memory, the decryptor
+	// can not decrypt content afterwards
+	Close()
+}
+
+// KeyFingerprinter is implemented by decryptors which hold key material that
+// was not loaded from a KeySource (eg. keys found on disk). The material is
+// written to w, which derives the secret of cache entries. Decryptors which
+// may decrypt without key material known to the process (eg. an external
+// binary without keys) return false, their renders are not cached.
+type KeyFingerprinter interface {
+	Fingerprint(w io.Writer) bool
 }
@@ -2,20 +2,17 @@ package ejson
 
 import (
 	"bytes"
-	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strings"
 
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-
-	"github.com/Shopify/ejson"
+	"github.com/Shopify/ejson/crypto"
+	ejsonjson "github.com/Shopify/ejson/json"
 	"github.com/bedag/subst/internal/decryptors"
-	"k8s.io/client-go/kubernetes"
+	"golang.org/x/crypto/curve25519"
 )
 
 const (
@@ -26,19 +23,31 @@ const (
 	DecryptionEjsonExt = ".key"
 )
 
+// Regular expression to match filenames of format [32]byte
+// Considering filenames to be hex encoded strings
+var keyFileRegex = regexp.MustCompile("^[a-fA-F0-9]{64}$")
+
 type EjsonDecryptor struct {
-	// stores all private keys for the decryptor
-	keys []string
+	// stores all key pairs for the decryptor, the private keys are decoded once
+	// and never copied into strings, so they can be zeroed on close
+	keys []*crypto.Keypair
 	// directory to search for ejson keys on disk
 	keyDirectory string
 	// Interface decryptor config
 	Config decryptors.DecryptorConfig
 }
 
+func init() {
+	// The optional argument is a directory to search for ejson keys on disk
+	decryptors.Register("ejson", func(config decryptors.DecryptorConfig, arg string) (decryptors.Decryptor, error) {
+		return NewEJSONDecryptor(config, arg)
+	})
+}
+
 // Initialize a new EJSON Decryptor
 func NewEJSONDecryptor(config decryptors.DecryptorConfig, keyDirectory string, keys ...string) (*EjsonDecryptor, error) {
 	init := &EjsonDecryptor{
-		keys:         []string{},
+		keys:         []*crypto.Keypair{},
 		keyDirectory: keyDirectory,
 		Config:       config,
 	}
@@ -79,43 +88,96 @@ func (d *EjsonDecryptor) IsEncrypted(data []byte) (bool, error) {
 }
 
 func (d *EjsonDecryptor) AddKey(key string) error {
-	privkeyBytes, err := hex.DecodeString(strings.TrimSpace(key))
-	if err != nil {
+	return d.addKey([]byte(key))
+}
+
+// adds a copy of the key, the given key material is not retained
+func (d *EjsonDecryptor) addKey(key []byte) error {
+	key = bytes.TrimSpace(key)
+	privkeyBytes := make([]byte, hex.DecodedLen(len(key)))
+	defer decryptors.Zero(privkeyBytes)
+	if _, err := hex.Decode(privkeyBytes, key); err != nil {
 		return err
 	}
 
 	if len(privkeyBytes) != 32 {
-		return fmt.Errorf("invalid private key length: %v", privkeyBytes)
+		return fmt.Errorf("invalid private key length: %d", len(privkeyBytes))
 	}
 
-	d.keys = append(d.keys, strings.TrimSpace(key))
+	kp := &crypto.Keypair{}
+	copy(kp.Private[:], privkeyBytes)
+	public, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		decryptors.Zero(kp.Private[:])
+		return err
+	}
+	copy(kp.Public[:], public)
+	d.keys = append(d.keys, kp)
 	return nil
 }
 
-// Load Keys from Kubernetes Secret
-// Only keys within the secret with the extension .key
-// will be loaded as ejson private keys
-func (d *EjsonDecryptor) KeysFromSecret(secretName string, namespace string, client *kubernetes.Clientset, ctx context.Context) (err error) {
-	keySecret, err := client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
-	if k8serrors.IsNotFound(err) {
-		return &decryptors.MissingKubernetesSecret{Secret: secretName, Namespace: namespace}
-	} else if err != nil {
-		return err
+// Fingerprint writes the loaded keys (including the keys found on disk)
+func (d *EjsonDecryptor) Fingerprint(w io.Writer) bool {
+	for _, kp := range d.keys {
+		fmt.Fprintf(w, "ejson:%d:", len(kp.Private))
+		_, _ = w.Write(kp.Private[:])
 	}
+	return true
+}
 
-	// Exract all keys from secret
-	for name, value := range keySecret.Data {
-		if filepath.Ext(name) == DecryptionEjsonExt {
-			err := d.AddKey(string(value))
+// Close removes all private keys from memory
+func (d *EjsonDecryptor) Close() {
+	for _, kp := range d.keys {
+		decryptors.Zero(kp.Private[:])
+	}
+	d.keys = nil
+}
+
+// Load Keys from key material
+// Named keys are only loaded, if their name has the extension .key
+// or is a public key (key directory layout). Unnamed keys are loaded,
+// if they are valid ejson private keys
+func (d *EjsonDecryptor) LoadKeys(keys []decryptors.Key) (err error) {
+	for _, key := range keys {
+		switch {
+		case key.Name == "":
+			// May belong to a different decryptor
+			if d.addKey(key.Value) != nil {
+				continue
+			}
+		case filepath.Ext(key.Name) == DecryptionEjsonExt || keyFileRegex.MatchString(key.Name):
+			err := d.addKey(key.Value)
 			if err != nil {
-				return fmt.Errorf("failed to import data from %s decryption Secret '%s': %w", name, secretName, err)
+				return fmt.Errorf("failed to import data from %s (%s): %w", key.Name, key.Source, err)
 			}
+		default:
+			continue
 		}
+		d.Config.Log().Info().Msgf("loaded ejson key for public key %s from %s", d.keys[len(d.keys)-1].PublicString(), key.Source)
 	}
 
 	return nil
 }
 
+// PublicKey derives the public key (hex encoded) of an ejson private key
+func PublicKey(key string) (string, error) {
+	return publicKey([]byte(key))
+}
+
+func publicKey(key []byte) (string, error) {
+	key = bytes.TrimSpace(key)
+	private := make([]byte, hex.DecodedLen(len(key)))
+	defer decryptors.Zero(private)
+	if _, err := hex.Decode(private, key); err != nil {
+		return "", err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(public), nil
+}
+
 // Read an ejson file
 // Skip decryption still removes the publicKeyField
 func (d *EjsonDecryptor) Decrypt(data []byte) (content map[string]interface{}, err error) {
@@ -138,42 +200,40 @@ func (d *EjsonDecryptor) Decrypt(data []byte) (content map[string]interface{}, e
 	return content, err
 }
 
-// Attempts to decrypt an ejson file with the given keys
+// Decrypts an ejson file with the key pair of its public key
 func (d *EjsonDecryptor) read(data []byte) (content []byte, err error) {
-	var outputBuffer bytes.Buffer
-
-	decrypted := false
-	f := bytes.NewReader(data)
-	if !d.Config.SkipDecrypt {
-
-		// Try all loaded keys
-		for key := range d.keys {
-			err = ejson.Decrypt(f, &outputBuffer, "", string(d.keys[key]))
-			if err != nil {
-				continue
-			} else {
-				decrypted = true
-				break
-			}
-		}
+	public, err := ejsonjson.ExtractPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt with given keys: %w", err)
+	}
+	kp := d.keyPair(public)
+	if kp == nil {
+		return nil, &decryptors.MissingKeyError{PublicKey: hex.EncodeToString(public[:])}
+	}
 
-		// Check if file was decrypted (and must be)
-		if !decrypted {
-			e := fmt.Errorf("could not decrypt with given keys")
-			// This error happens, if the file is not properly encrypted (or not encrypted at all)
-			// Considered an error.
-			if err != nil && err.Error() == "invalid message format" {
-				e = fmt.Errorf("content is not encrypted with ejson (%s)", err)
-			}
-			return nil, e
+	walker := ejsonjson.Walker{
+		Action: kp.Decrypter().Decrypt,
+	}
+	content, err = walker.Walk(data)
+	if err != nil {
+		// This error happens, if the file is not properly encrypted (or not encrypted at all)
+		// Considered an error.
+		if err.Error() == "invalid message format" {
+			return nil, fmt.Errorf("content is not encrypted with ejson (%s)", err)
 		}
+		return nil, fmt.Errorf("could not decrypt with given keys: %w", err)
 	}
+	return content, nil
+}
 
-	if outputBuffer.Bytes() != nil {
-		return outputBuffer.Bytes(), nil
+// returns the loaded key pair of the public key, nil if the private key is not loaded
+func (d *EjsonDecryptor) keyPair(public [32]byte) *crypto.Keypair {
+	for _, kp := range d.keys {
+		if kp.Public == public {
+			return kp
+		}
 	}
-
-	return data, nil
+	return nil
 }
 
 func (d *EjsonDecryptor) findPrivateKeysFromDisk() error {
@@ -185,18 +245,15 @@ func (d *EjsonDecryptor) findPrivateKeysFromDisk() error {
 		return err
 	}
 
-	// Regular expression to match filenames of format [32]byte
-	// Considering filenames to be hex encoded strings
-	r := regexp.MustCompile("^[a-fA-F0-9]{64}$")
-
 	for _, file := range files {
-		if !file.IsDir() && r.MatchString(file.Name()) {
+		if !file.IsDir() && keyFileRegex.MatchString(file.Name()) {
 			// Step 4: Read the content of the matching files
 			content, err := os.ReadFile(d.keyDirectory + "/" + file.Name())
 			if err != nil {
 				return err
 			}
-			err = d.AddKey(string(content))
+			err = d.addKey(content)
+			decryptors.Zero(content)
 			if err != nil {
 				return err
 			}
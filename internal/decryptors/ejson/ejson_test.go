@@ -1,9 +1,11 @@
 package ejson
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bedag/subst/internal/decryptors"
@@ -40,6 +42,24 @@ const FaultyEjsonContent = `{
 	}
 }`
 
+// decoded private keys of the decryptor
+func privateKeys(d *EjsonDecryptor) [][32]byte {
+	keys := [][32]byte{}
+	for _, kp := range d.keys {
+		keys = append(keys, kp.Private)
+	}
+	return keys
+}
+
+// decodes a hex encoded private key
+func decodeKey(t *testing.T, key string) [32]byte {
+	var k [32]byte
+	b, err := hex.DecodeString(strings.TrimSpace(key))
+	assert.NoError(t, err)
+	copy(k[:], b)
+	return k
+}
+
 func testdataPath() string {
 	basePath, _ := os.Getwd()
 	hackDirPath := filepath.Join(basePath, "testdata")
@@ -59,7 +79,7 @@ func TestAddKey(t *testing.T) {
 	err = decryptor.AddKey(mockPrivateKey)
 
 	assert.NoError(t, err, "Expected no error when adding a private key")
-	assert.Contains(t, decryptor.keys, mockPrivateKey, "Expected the key to be added to the keys slice")
+	assert.Contains(t, privateKeys(decryptor), decodeKey(t, mockPrivateKey), "Expected the key to be added to the keys slice")
 }
 
 func TestMultipleKeyFromDiskAddition(t *testing.T) {
@@ -75,8 +95,7 @@ func TestMultipleKeyFromDiskAddition(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to read file: %v", err)
 			}
-			keyContent := string(content)
-			assert.Contains(t, decryptor.keys, keyContent, "Expected the key to be added to the keys slice")
+			assert.Contains(t, privateKeys(decryptor), decodeKey(t, string(content)), "Expected the key to be added to the keys slice")
 		}
 	}
 	expectedSize := 3
@@ -108,7 +127,7 @@ func TestMultipleKeyAddition(t *testing.T) {
 
 	// Test at the end if all keys are added
 	for _, key := range keysFromFile {
-		assert.Contains(t, decryptor.keys, key, "Expected the key to be added to the keys slice")
+		assert.Contains(t, privateKeys(decryptor), decodeKey(t, key), "Expected the key to be added to the keys slice")
 	}
 }
 
@@ -121,7 +140,7 @@ func TestAddFaultyKey(t *testing.T) {
 	err = decryptor.AddKey(faultyKey)
 
 	assert.Error(t, err, "Expected error when adding a faulty private key")
-	assert.NotContains(t, decryptor.keys, faultyKey, "Did not expect the key to be added to the keys slice")
+	assert.Empty(t, decryptor.keys, "Did not expect the key to be added to the keys slice")
 }
 
 func TestIsEncrypted(t *testing.T) {
@@ -155,3 +174,44 @@ func TestDecrypt(t *testing.T) {
 	// Compare the decrypted content with the expected value
 	assert.Equal(t, expectedMap, decryptedContent, "The decrypted content does not match the expected value.")
 }
+
+func TestLoadKeys(t *testing.T) {
+	decryptor, err := NewEJSONDecryptor(decryptors.DecryptorConfig{}, "")
+	if err != nil {
+		t.Fatalf("Failed to create decryptor: %v", err)
+	}
+
+	err = decryptor.LoadKeys([]decryptors.Key{
+		{Name: "app.key", Value: []byte(mockPrivateKey)},
+		{Name: "other.txt", Value: []byte("ignored")},
+		{Value: []byte("not-an-ejson-key")},
+	})
+	assert.NoError(t, err, "Expected no error when loading keys")
+	assert.Equal(t, [][32]byte{decodeKey(t, mockPrivateKey)}, privateKeys(decryptor), "Expected only the .key entry to be loaded")
+
+	err = decryptor.LoadKeys([]decryptors.Key{{Name: "faulty.key", Value: []byte("faulty")}})
+	assert.Error(t, err, "Expected error when loading a faulty .key entry")
+}
+
+func TestPublicKey(t *testing.T) {
+	public, err := PublicKey(mockPrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "9474413baa1422b613beed7fd2ba8201d433758dc94aaee4d385d0c948176c4d", public)
+
+	_, err = PublicKey("not-hex")
+	assert.Error(t, err)
+}
+
+func TestClose(t *testing.T) {
+	decryptor, err := NewEJSONDecryptor(decryptors.DecryptorConfig{}, "", mockPrivateKey)
+	assert.NoError(t, err)
+	kp := decryptor.keys[0]
+	assert.Equal(t, "9474413baa1422b613beed7fd2ba8201d433758dc94aaee4d385d0c948176c4d", kp.PublicString())
+
+	decryptor.Close()
+	assert.Equal(t, [32]byte{}, kp.Private, "Expected the key material to be zeroed")
+	assert.Empty(t, decryptor.keys)
+
+	_, err = decryptor.Decrypt([]byte(EncryptedEjsonContent))
+	assert.Error(t, err, "Expected decryption to fail after close")
+}
@@ -0,0 +1,79 @@
+package decryptors
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type MissingKubernetesSecret struct {
+	Secret    string
+	Namespace string
+	// Set if the Secrets were looked up by label selector
+	Selector string
+}
+
+func (e *MissingKubernetesSecret) Error() string {
+	if e.Selector != "" {
+		return fmt.Sprintf("no Secret matches %s in %s", e.Selector, e.Namespace)
+	}
+	return fmt.Sprintf("Secret not found: %s/%s", e.Namespace, e.Secret)
+}
+
+// KeyLookupError is returned if keys could not be read from a source
+type KeyLookupError struct {
+	// Source which was tried (eg. "secret argocd/app")
+	Source string
+	// Short reason for the failure
+	Reason string
+	Err    error
+}
+
+// NewKeyLookupError classifies the error of a key source
+func NewKeyLookupError(source string, err error) *KeyLookupError {
+	reason := "lookup failed"
+	var missing *MissingKubernetesSecret
+	switch {
+	case errors.As(err, &missing):
+		reason = "not found"
+	case k8serrors.IsForbidden(err):
+		reason = "access denied, check the RBAC permissions of the plugin"
+	case k8serrors.IsUnauthorized(err):
+		reason = "unauthorized, check the kubeconfig or service account"
+	}
+	return &KeyLookupError{Source: source, Reason: reason, Err: err}
+}
+
+func (e *KeyLookupError) Error() string {
+	return fmt.Sprintf("failed to read keys from %s (%s): %s", e.Source, e.Reason, e.Err)
+}
+
+func (e *KeyLookupError) Unwrap() error {
+	return e.Err
+}
+
+// MissingKeyError is returned if content is encrypted for a key which was not loaded
+type MissingKeyError struct {
+	// Public key the content was encrypted for
+	PublicKey string
+	// Failed key lookups, which may have provided the key
+	Lookups []error
+}
+
+func (e *MissingKeyError) Error() string {
+	msg := fmt.Sprintf("no private key loaded for public key %s", e.PublicKey)
+	if len(e.Lookups) == 0 {
+		return msg
+	}
+	failures := make([]string, len(e.Lookups))
+	for i, err := range e.Lookups {
+		failures[i] = err.Error()
+	}
+	return fmt.Sprintf("%s (%s)", msg, strings.Join(failures, "; "))
+}
+
+func (e *MissingKeyError) Unwrap() []error {
+	return e.Lookups
+}
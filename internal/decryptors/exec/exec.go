@@ -0,0 +1,225 @@
+// Package exec implements a decryptor which delegates to an external binary.
+//
+// The binary is invoked once per operation, the answers for "is_encrypted"
+// are cached per content. It receives a single JSON request
+// on stdin and must answer with a single JSON response on stdout:
+//
+//	Request:
+//	{
+//	  "version": 1,
+//	  "operation": "is_encrypted" | "decrypt",
+//	  "data": "<base64 encoded content>",
+//	  "skip_decrypt": false,
+//	  "keys": [{"name": "<name>", "source": "<source>", "value": "<base64 encoded key>"}]
+//	}
+//
+//	Response:
+//	{
+//	  "encrypted": true,           // for "is_encrypted"
+//	  "content": {"key": "value"}, // for "decrypt", the decrypted document
+//	  "error": "<message>"         // set if the operation failed
+//	}
+//
+// A non-zero exit code is considered a failure, stderr is added to the error.
+// The binary is stopped after DefaultTimeout (see DecryptorConfig.Timeout) or
+// once the context of the build is done.
+// Keys passed to the binary are unnamed keys and keys with the extension ".exec".
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bedag/subst/internal/decryptors"
+)
+
+const (
+	// ProtocolVersion is the version of the request sent to the binary
+	ProtocolVersion = 1
+	// DecryptionExecExt is the extension of keys which are passed to the binary
+	DecryptionExecExt = ".exec"
+
+	OperationIsEncrypted = "is_encrypted"
+	OperationDecrypt     = "decrypt"
+
+	// DefaultTimeout of a single invocation of the binary
+	DefaultTimeout = 30 * time.Second
+)
+
+type Request struct {
+	Version     int    `json:"version"`
+	Operation   string `json:"operation"`
+	Data        []byte `json:"data"`
+	SkipDecrypt bool   `json:"skip_decrypt"`
+	Keys        []Key  `json:"keys"`
+}
+
+type Key struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Value  []byte `json:"value"`
+}
+
+type Response struct {
+	Encrypted bool                   `json:"encrypted"`
+	Content   map[string]interface{} `json:"content"`
+	Error     string                 `json:"error"`
+}
+
+type ExecDecryptor struct {
+	// binary and arguments to run
+	command string
+	args    []string
+	// keys passed to the binary
+	keys []Key
+	// answers for is_encrypted by sha256 of the content
+	mu        sync.Mutex
+	encrypted map[[sha256.Size]byte]bool
+	// Interface decryptor config
+	Config decryptors.DecryptorConfig
+}
+
+func init() {
+	// The argument is the binary (with optional arguments) to run
+	decryptors.Register("exec", func(config decryptors.DecryptorConfig, arg string) (decryptors.Decryptor, error) {
+		return NewExecDecryptor(config, arg)
+	})
+}
+
+// Initialize a new Exec Decryptor
+func NewExecDecryptor(config decryptors.DecryptorConfig, command string) (*ExecDecryptor, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("exec decryptor requires a command (eg. exec=/usr/local/bin/decrypt)")
+	}
+	return &ExecDecryptor{
+		command: fields[0],
+		args:    fields[1:],
+		Config:  config,
+	}, nil
+}
+
+func (d *ExecDecryptor) IsEncrypted(data []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+	sum := sha256.Sum256(data)
+	d.mu.Lock()
+	encrypted, cached := d.encrypted[sum]
+	d.mu.Unlock()
+	if cached {
+		return encrypted, nil
+	}
+
+	resp, err := d.run(OperationIsEncrypted, data)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	if d.encrypted == nil {
+		d.encrypted = make(map[[sha256.Size]byte]bool)
+	}
+	d.encrypted[sum] = resp.Encrypted
+	d.mu.Unlock()
+	return resp.Encrypted, nil
+}
+
+func (d *ExecDecryptor) Decrypt(data []byte) (content map[string]interface{}, err error) {
+	resp, err := d.run(OperationDecrypt, data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Content == nil {
+		return map[string]interface{}{}, nil
+	}
+	return resp.Content, nil
+}
+
+func (d *ExecDecryptor) LoadKeys(keys []decryptors.Key) (err error) {
+	for _, key := range keys {
+		if key.Name == "" || filepath.Ext(key.Name) == DecryptionExecExt {
+			value := make([]byte, len(key.Value))
+			copy(value, key.Value)
+			d.keys = append(d.keys, Key{Name: key.Name, Source: key.Source, Value: value})
+		}
+	}
+	return nil
+}
+
+// Fingerprint writes the command, the binary may hold its own key material.
+// It is only known to decrypt with the loaded keys, which are part of the
+// fingerprint of their key source.
+func (d *ExecDecryptor) Fingerprint(w io.Writer) bool {
+	fmt.Fprintf(w, "exec:%q:%q:", d.command, d.args)
+	return len(d.keys) > 0
+}
+
+func (d *ExecDecryptor) Close() {
+	for _, key := range d.keys {
+		decryptors.Zero(key.Value)
+	}
+	d.keys = nil
+}
+
+// runs the binary for a single operation
+func (d *ExecDecryptor) run(operation string, data []byte) (*Response, error) {
+	req, err := json.Marshal(Request{
+		Version:     ProtocolVersion,
+		Operation:   operation,
+		Data:        data,
+		SkipDecrypt: d.Config.SkipDecrypt,
+		Keys:        d.keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The request contains the keys
+	defer decryptors.Zero(req)
+
+	ctx := d.Config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := d.Config.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.command, d.args...)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Children of the binary may keep the output open
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%s %s timed out after %s: %w", d.command, operation, timeout, ctx.Err())
+			}
+			return nil, fmt.Errorf("%s %s canceled: %w", d.command, operation, ctx.Err())
+		}
+		return nil, fmt.Errorf("%s %s failed: %s: %w", d.command, operation, strings.TrimSpace(stderr.String()), err)
+	}
+
+	resp := &Response{}
+	if err := json.Unmarshal(stdout.Bytes(), resp); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", d.command, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,122 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bedag/subst/internal/decryptors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Acts as external decryptor binary when invoked by the tests
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("SUBST_EXEC_HELPER") != "1" {
+		return
+	}
+	if os.Getenv("SUBST_EXEC_HELPER_SLEEP") != "" {
+		time.Sleep(time.Minute)
+	}
+	var req Request
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	resp := Response{}
+	encrypted := strings.HasPrefix(string(req.Data), "ENC:")
+	switch req.Operation {
+	case OperationIsEncrypted:
+		resp.Encrypted = encrypted
+	case OperationDecrypt:
+		if len(req.Keys) == 0 {
+			resp.Error = "no keys"
+			break
+		}
+		resp.Content = map[string]interface{}{
+			"value": strings.TrimPrefix(string(req.Data), "ENC:"),
+			"key":   string(req.Keys[0].Value),
+		}
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(resp)
+	os.Exit(0)
+}
+
+func helperDecryptor(t *testing.T) decryptors.Decryptor {
+	return helperDecryptorWithConfig(t, decryptors.DecryptorConfig{})
+}
+
+func helperDecryptorWithConfig(t *testing.T, config decryptors.DecryptorConfig) decryptors.Decryptor {
+	t.Setenv("SUBST_EXEC_HELPER", "1")
+	d, err := decryptors.New(config, "exec="+os.Args[0]+" -test.run=TestHelperProcess")
+	if err != nil {
+		t.Fatalf("Failed to create decryptor: %v", err)
+	}
+	return d
+}
+
+func TestExecDecryptor(t *testing.T) {
+	d := helperDecryptor(t)
+
+	encrypted, err := d.IsEncrypted([]byte("ENC:secret"))
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+
+	encrypted, err = d.IsEncrypted([]byte("plain"))
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+
+	// Answers are cached, the binary is not invoked again
+	command := d.(*ExecDecryptor).command
+	d.(*ExecDecryptor).command = "/nonexistent"
+	encrypted, err = d.IsEncrypted([]byte("ENC:secret"))
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	d.(*ExecDecryptor).command = command
+
+	_, err = d.Decrypt([]byte("ENC:secret"))
+	assert.EqualError(t, err, "no keys")
+
+	err = d.LoadKeys([]decryptors.Key{
+		{Name: "app.key", Value: []byte("ejson")},
+		{Name: "hsm.exec", Value: []byte("hsm")},
+	})
+	assert.NoError(t, err)
+
+	content, err := d.Decrypt([]byte("ENC:secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"value": "secret", "key": "hsm"}, content)
+}
+
+func TestExecTimeout(t *testing.T) {
+	t.Setenv("SUBST_EXEC_HELPER_SLEEP", "1")
+
+	// The binary is stopped after the timeout
+	d := helperDecryptorWithConfig(t, decryptors.DecryptorConfig{Timeout: 100 * time.Millisecond})
+	start := time.Now()
+	_, err := d.IsEncrypted([]byte("ENC:secret"))
+	assert.ErrorContains(t, err, "timed out after 100ms")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// And once the context of the build is done
+	ctx, cancel := context.WithCancel(context.Background())
+	d = helperDecryptorWithConfig(t, decryptors.DecryptorConfig{Context: ctx})
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = d.Decrypt([]byte("ENC:secret"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestUnknownDecryptor(t *testing.T) {
+	_, err := decryptors.New(decryptors.DecryptorConfig{}, "unknown")
+	assert.Error(t, err)
+
+	_, err = decryptors.New(decryptors.DecryptorConfig{}, "exec")
+	assert.Error(t, err)
+}
@@ -0,0 +1,243 @@
+package decryptors
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Key is key material read from a KeySource
+type Key struct {
+	// Name of the entry the key was read from (eg. Secret data key or file name).
+	// Empty if the source does not name its keys, in that case every decryptor
+	// may attempt to use the key.
+	Name string
+	// Raw key material
+	Value []byte
+	// Source the key was read from
+	Source string
+}
+
+// KeySource provides key material for decryptors
+type KeySource interface {
+	// Describes the source for logs and errors
+	String() string
+	// Reads all keys from the source
+	Keys(ctx context.Context) ([]Key, error)
+}
+
+// Reads keys from the data of a Kubernetes Secret
+type SecretKeySource struct {
+	Name      string
+	Namespace string
+	Client    kubernetes.Interface
+}
+
+func (s *SecretKeySource) String() string {
+	return fmt.Sprintf("secret %s/%s", s.Namespace, s.Name)
+}
+
+func (s *SecretKeySource) Keys(ctx context.Context) ([]Key, error) {
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, &MissingKubernetesSecret{Secret: s.Name, Namespace: s.Namespace}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return secretKeys(secret.Data, s.String()), nil
+}
+
+// Reads keys from all Secrets in a namespace matching a label selector.
+// Secrets are read in the order of their names, which allows to rotate keys
+// by adding a new Secret.
+type SecretSelectorKeySource struct {
+	Selector  string
+	Namespace string
+	Client    kubernetes.Interface
+}
+
+func (s *SecretSelectorKeySource) String() string {
+	return fmt.Sprintf("secrets %s in %s", s.Selector, s.Namespace)
+}
+
+func (s *SecretSelectorKeySource) Keys(ctx context.Context) ([]Key, error) {
+	list, err := s.Client.CoreV1().Secrets(s.Namespace).List(ctx, metav1.ListOptions{LabelSelector: s.Selector})
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := list.Items
+	if len(secrets) == 0 {
+		return nil, &MissingKubernetesSecret{Selector: s.Selector, Namespace: s.Namespace}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+
+	var keys []Key
+	for _, secret := range secrets {
+		keys = append(keys, secretKeys(secret.Data, fmt.Sprintf("secret %s/%s", secret.Namespace, secret.Name))...)
+	}
+	return keys, nil
+}
+
+// named keys from secret data, sorted by name
+func secretKeys(data map[string][]byte, source string) []Key {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := make([]Key, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, Key{Name: name, Value: data[name], Source: source})
+	}
+	return keys
+}
+
+// Reads keys from a single file or all files within a directory (not recursive).
+// Keys read from a single file are not named, keys from a directory are
+// named by their file name.
+type FileKeySource struct {
+	Path string
+}
+
+func (s *FileKeySource) String() string {
+	return fmt.Sprintf("file %s", s.Path)
+}
+
+func (s *FileKeySource) Keys(ctx context.Context) ([]Key, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		content, err := os.ReadFile(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitKeys(content, s.String()), nil
+	}
+
+	files, err := os.ReadDir(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(s.Path, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, Key{Name: file.Name(), Value: content, Source: s.String()})
+	}
+	return keys, nil
+}
+
+// Reads keys from an environment variable (one key per line)
+type EnvKeySource struct {
+	Variable string
+	// Environment to read the variable from, the process environment is
+	// never read (nil is an empty environment)
+	Env map[string]string
+}
+
+func (s *EnvKeySource) String() string {
+	return fmt.Sprintf("env %s", s.Variable)
+}
+
+func (s *EnvKeySource) Keys(ctx context.Context) ([]Key, error) {
+	value, ok := s.Env[s.Variable]
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", s.Variable)
+	}
+	return splitKeys([]byte(value), s.String()), nil
+}
+
+// Reads keys from the stdout of a command (one key per line)
+type ExecKeySource struct {
+	Command string
+	Args    []string
+}
+
+func (s *ExecKeySource) String() string {
+	return fmt.Sprintf("exec %s", s.Command)
+}
+
+func (s *ExecKeySource) Keys(ctx context.Context) ([]Key, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Command, s.Args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %w", s, strings.TrimSpace(stderr.String()), err)
+	}
+	return splitKeys(stdout.Bytes(), s.String()), nil
+}
+
+// Provides keys which were given directly (eg. as flag values)
+type StaticKeySource struct {
+	// Describes where the keys were given
+	Origin  string
+	Entries []Key
+}
+
+func (s *StaticKeySource) String() string {
+	return s.Origin
+}
+
+func (s *StaticKeySource) Keys(ctx context.Context) ([]Key, error) {
+	keys := make([]Key, len(s.Entries))
+	for i, key := range s.Entries {
+		key.Source = s.String()
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// Parses a source reference of the format "<type>:<value>"
+// (eg. "file:/keys", "env:EJSON_KEY" or "exec:/usr/bin/get-keys --all"),
+// env sources read from the given environment
+func ParseKeySource(ref string, env map[string]string) (KeySource, error) {
+	kind, value, found := strings.Cut(ref, ":")
+	if !found || value == "" {
+		return nil, fmt.Errorf("invalid key source %q, expected <type>:<value>", ref)
+	}
+	switch kind {
+	case "file":
+		return &FileKeySource{Path: value}, nil
+	case "env":
+		return &EnvKeySource{Variable: value, Env: env}, nil
+	case "exec":
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid key source %q, command is empty", ref)
+		}
+		return &ExecKeySource{Command: fields[0], Args: fields[1:]}, nil
+	}
+	return nil, fmt.Errorf("unknown key source type %q (supported: file, env, exec)", kind)
+}
+
+// unnamed keys, one per non-empty line
+func splitKeys(content []byte, source string) (keys []Key) {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			keys = append(keys, Key{Value: line, Source: source})
+		}
+	}
+	return keys
+}
@@ -0,0 +1,98 @@
+package decryptors
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretKeySource(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "argocd"},
+		Data: map[string][]byte{
+			"b.key": []byte("second"),
+			"a.key": []byte("first"),
+		},
+	})
+
+	keys, err := (&SecretKeySource{Name: "app", Namespace: "argocd", Client: client}).Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{
+		{Name: "a.key", Value: []byte("first"), Source: "secret argocd/app"},
+		{Name: "b.key", Value: []byte("second"), Source: "secret argocd/app"},
+	}, keys)
+
+	_, err = (&SecretKeySource{Name: "missing", Namespace: "argocd", Client: client}).Keys(context.Background())
+	var missing *MissingKubernetesSecret
+	assert.True(t, errors.As(err, &missing))
+}
+
+func TestSecretSelectorKeySource(t *testing.T) {
+	labels := map[string]string{"subst.bedag.ch/keys": "shared"}
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared-2024", Namespace: "argocd", Labels: labels},
+			Data:       map[string][]byte{"a.key": []byte("new")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared-2023", Namespace: "argocd", Labels: labels},
+			Data:       map[string][]byte{"a.key": []byte("old")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "argocd"},
+			Data:       map[string][]byte{"a.key": []byte("other")},
+		},
+	)
+
+	keys, err := (&SecretSelectorKeySource{Selector: "subst.bedag.ch/keys=shared", Namespace: "argocd", Client: client}).Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{
+		{Name: "a.key", Value: []byte("old"), Source: "secret argocd/shared-2023"},
+		{Name: "a.key", Value: []byte("new"), Source: "secret argocd/shared-2024"},
+	}, keys)
+}
+
+func TestFileKeySource(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "one"), []byte("first\n"), 0600))
+
+	keys, err := (&FileKeySource{Path: dir}).Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{{Name: "one", Value: []byte("first\n"), Source: "file " + dir}}, keys)
+
+	file := filepath.Join(dir, "one")
+	keys, err = (&FileKeySource{Path: file}).Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{{Value: []byte("first"), Source: "file " + file}}, keys)
+}
+
+func TestEnvAndExecKeySource(t *testing.T) {
+	source, err := ParseKeySource("env:SUBST_TEST_KEYS", map[string]string{"SUBST_TEST_KEYS": "first\n\nsecond"})
+	assert.NoError(t, err)
+	keys, err := source.Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	// The process environment is never read
+	t.Setenv("SUBST_TEST_KEYS", "process")
+	source, err = ParseKeySource("env:SUBST_TEST_KEYS", nil)
+	assert.NoError(t, err)
+	_, err = source.Keys(context.Background())
+	assert.Error(t, err)
+
+	source, err = ParseKeySource("exec:echo third", nil)
+	assert.NoError(t, err)
+	keys, err = source.Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{{Value: []byte("third"), Source: "exec echo"}}, keys)
+
+	_, err = ParseKeySource("vault:secret", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package decryptors
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a new decryptor. The argument is the optional value given
+// with the decryptor selection (eg. "/usr/bin/hsm" for "exec=/usr/bin/hsm")
+type Factory func(config DecryptorConfig, arg string) (Decryptor, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a decryptor backend available by the given name.
+// Backends register themselves in their init function.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("decryptor %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered returns the names of all registered backends
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a decryptor from a selection of the format "<name>[=<arg>]"
+func New(config DecryptorConfig, selection string) (Decryptor, error) {
+	name, arg, _ := strings.Cut(selection, "=")
+
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown decryptor %q (available: %s)", name, strings.Join(Registered(), ", "))
+	}
+
+	d, err := factory(config, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decryptor %q: %w", name, err)
+	}
+	return d, nil
+}
@@ -2,18 +2,15 @@ package decryptors
 
 import (
 	"encoding/json"
-	"fmt"
 
 	"gopkg.in/yaml.v3"
 )
 
-type MissingKubernetesSecret struct {
-	Secret    string
-	Namespace string
-}
-
-func (e *MissingKubernetesSecret) Error() string {
-	return fmt.Sprintf("Secret not found: %s/%s", e.Namespace, e.Secret)
+// Zero overwrites the given key material
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
 
 func UnmarshalJSONorYAML(data []byte) (map[string]interface{}, error) {
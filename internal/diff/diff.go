@@ -0,0 +1,408 @@
+package diff
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bedag/subst/internal/utils"
+)
+
+type ChangeType string
+
+const (
+	Added   ChangeType = "+"
+	Removed ChangeType = "-"
+	Changed ChangeType = "~"
+)
+
+type Options struct {
+	// Show values of Secret data/stringData instead of redacting them
+	RevealSecrets bool
+	// Field paths which are not compared (eg. "status", "metadata.managedFields")
+	IgnorePaths []string
+	// Fields which are only present in the source are not reported (eg. fields
+	// defaulted by the API server)
+	DesiredOnly bool
+	// Secret stringData of the target is compared as base64 encoded data, as
+	// stored by the API server
+	StringData bool
+}
+
+// Identifies a resource by group, version, kind, namespace and name
+type ResourceID struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+func (id ResourceID) String() string {
+	name := id.Name
+	if id.Namespace != "" {
+		name = id.Namespace + "/" + id.Name
+	}
+	return fmt.Sprintf("%s, Kind=%s %s", id.APIVersion, id.Kind, name)
+}
+
+// Single field change within a resource
+type FieldChange struct {
+	Type ChangeType
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// All changes of a single resource, field changes are only
+// collected for changed resources
+type ResourceDiff struct {
+	ID     ResourceID
+	Type   ChangeType
+	Fields []FieldChange
+}
+
+// ID returns the identity of the given manifest
+func ID(manifest map[interface{}]interface{}) ResourceID {
+	id := ResourceID{
+		APIVersion: stringValue(manifest["apiVersion"]),
+		Kind:       stringValue(manifest["kind"]),
+	}
+	if metadata, ok := asMap(manifest["metadata"]); ok {
+		id.Namespace = stringValue(metadata["namespace"])
+		id.Name = stringValue(metadata["name"])
+	}
+	return id
+}
+
+// Resources compares two sets of manifests. Resources are matched by their identity
+// and compared field by field. Only resources with differences are returned.
+func Resources(from []map[interface{}]interface{}, to []map[interface{}]interface{}, opts Options) []ResourceDiff {
+	fromIndex, fromOrder := index(from)
+	toIndex, toOrder := index(to)
+
+	var diffs []ResourceDiff
+	for _, id := range fromOrder {
+		current, ok := toIndex[id]
+		if !ok {
+			diffs = append(diffs, ResourceDiff{ID: id, Type: Removed})
+			continue
+		}
+		if opts.StringData && id.Kind == "Secret" {
+			current = stringData(current)
+		}
+		var changes []FieldChange
+		compare("", fromIndex[id], current, id, opts, &changes)
+		if len(changes) > 0 {
+			diffs = append(diffs, ResourceDiff{ID: id, Type: Changed, Fields: changes})
+		}
+	}
+	for _, id := range toOrder {
+		if _, ok := fromIndex[id]; !ok {
+			diffs = append(diffs, ResourceDiff{ID: id, Type: Added})
+		}
+	}
+	return diffs
+}
+
+// Print writes the diffs in a human readable format
+func Print(w io.Writer, diffs []ResourceDiff) error {
+	for _, d := range diffs {
+		if _, err := fmt.Fprintf(w, "%s %s\n", d.Type, d.ID); err != nil {
+			return err
+		}
+		if d.Type != Changed {
+			continue
+		}
+		for _, f := range d.Fields {
+			var line string
+			switch f.Type {
+			case Added:
+				line = fmt.Sprintf("    + %s: %s", f.Path, format(f.New))
+			case Removed:
+				line = fmt.Sprintf("    - %s: %s", f.Path, format(f.Old))
+			default:
+				line = fmt.Sprintf("    ~ %s: %s -> %s", f.Path, format(f.Old), format(f.New))
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func index(manifests []map[interface{}]interface{}) (map[ResourceID]map[interface{}]interface{}, []ResourceID) {
+	idx := make(map[ResourceID]map[interface{}]interface{}, len(manifests))
+	order := make([]ResourceID, 0, len(manifests))
+	for _, m := range manifests {
+		id := ID(m)
+		if _, ok := idx[id]; !ok {
+			order = append(order, id)
+		}
+		idx[id] = m
+	}
+	return idx, order
+}
+
+// returns a copy of the Secret with the stringData merged into the data
+// (base64 encoded), stringData takes precedence like on the API server
+func stringData(secret map[interface{}]interface{}) map[interface{}]interface{} {
+	values, ok := asMap(secret["stringData"])
+	if !ok {
+		return secret
+	}
+	out := make(map[interface{}]interface{}, len(secret))
+	for k, v := range secret {
+		out[k] = v
+	}
+	delete(out, "stringData")
+	data := map[interface{}]interface{}{}
+	if existing, ok := asMap(secret["data"]); ok {
+		for k, v := range existing {
+			data[k] = v
+		}
+	}
+	for k, v := range values {
+		data[k] = base64.StdEncoding.EncodeToString([]byte(stringValue(v)))
+	}
+	out["data"] = data
+	return out
+}
+
+// compare two values recursive and collect the changes
+func compare(path string, old interface{}, current interface{}, id ResourceID, opts Options, changes *[]FieldChange) {
+	if ignored(path, opts) {
+		return
+	}
+
+	oldMap, oldIsMap := asMap(old)
+	newMap, newIsMap := asMap(current)
+	if oldIsMap && newIsMap {
+		for _, k := range keys(oldMap, newMap) {
+			o, inOld := oldMap[k]
+			n, inNew := newMap[k]
+			p := join(path, k)
+			switch {
+			case !inNew:
+				if !opts.DesiredOnly && !ignored(p, opts) {
+					*changes = append(*changes, mask(FieldChange{Type: Removed, Path: p, Old: o}, id, opts))
+				}
+			case !inOld:
+				if !ignored(p, opts) {
+					*changes = append(*changes, mask(FieldChange{Type: Added, Path: p, New: n}, id, opts))
+				}
+			default:
+				compare(p, o, n, id, opts, changes)
+			}
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := current.([]interface{})
+	if oldIsList && newIsList {
+		compareList(path, oldList, newList, id, opts, changes)
+		return
+	}
+
+	if !reflect.DeepEqual(number(old), number(current)) {
+		*changes = append(*changes, mask(FieldChange{Type: Changed, Path: path, Old: old, New: current}, id, opts))
+	}
+}
+
+// compares the elements of two lists. Elements of named lists (eg.
+// containers or env) are matched by their name, other lists by index.
+// Added and removed elements are reported as single changes, also with
+// DesiredOnly (elements are not defaulted by the API server).
+func compareList(path string, old []interface{}, current []interface{}, id ResourceID, opts Options, changes *[]FieldChange) {
+	oldNames, oldNamed := names(old)
+	newNames, newNamed := names(current)
+	if !oldNamed || !newNamed {
+		for i := 0; i < len(old) || i < len(current); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case ignored(p, opts):
+			case i >= len(current):
+				*changes = append(*changes, mask(FieldChange{Type: Removed, Path: p, Old: old[i]}, id, opts))
+			case i >= len(old):
+				*changes = append(*changes, mask(FieldChange{Type: Added, Path: p, New: current[i]}, id, opts))
+			default:
+				compare(p, old[i], current[i], id, opts, changes)
+			}
+		}
+		return
+	}
+
+	index := make(map[string]int, len(current))
+	for i, name := range newNames {
+		index[name] = i
+	}
+	found := make(map[string]bool, len(old))
+	for i, name := range oldNames {
+		p := fmt.Sprintf("%s[name=%s]", path, name)
+		found[name] = true
+		j, ok := index[name]
+		switch {
+		case ignored(p, opts):
+		case !ok:
+			*changes = append(*changes, mask(FieldChange{Type: Removed, Path: p, Old: old[i]}, id, opts))
+		default:
+			compare(p, old[i], current[j], id, opts, changes)
+		}
+	}
+	for j, name := range newNames {
+		p := fmt.Sprintf("%s[name=%s]", path, name)
+		if !found[name] && !ignored(p, opts) {
+			*changes = append(*changes, mask(FieldChange{Type: Added, Path: p, New: current[j]}, id, opts))
+		}
+	}
+}
+
+// returns the names of the list elements, if all elements are maps with a
+// unique name
+func names(list []interface{}) ([]string, bool) {
+	out := make([]string, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, item := range list {
+		m, ok := asMap(item)
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok || name == "" || seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+		out = append(out, name)
+	}
+	return out, true
+}
+
+// redacts values of secret data (see utils.Redact), changes remain visible
+// as the placeholders differ
+func mask(change FieldChange, id ResourceID, opts Options) FieldChange {
+	if opts.RevealSecrets || id.Kind != "Secret" {
+		return change
+	}
+	if !within(change.Path, "data") && !within(change.Path, "stringData") {
+		return change
+	}
+	if change.Old != nil {
+		change.Old = redact(change.Old)
+	}
+	if change.New != nil {
+		change.New = redact(change.New)
+	}
+	return change
+}
+
+// replaces the values (of maps and lists) by their placeholder
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			out[k] = redact(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redact(item)
+		}
+		return out
+	}
+	return utils.Redact(stringValue(value))
+}
+
+func ignored(path string, opts Options) bool {
+	for _, p := range opts.IgnorePaths {
+		if within(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if path equals the prefix or is a child of it
+func within(path string, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+".") || strings.HasPrefix(path, prefix+"[")
+}
+
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = val
+		}
+		return m, true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
+
+func keys(a map[string]interface{}, b map[string]interface{}) []string {
+	set := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		set[k] = struct{}{}
+	}
+	for k := range b {
+		set[k] = struct{}{}
+	}
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	default:
+		if m, ok := asMap(v); ok {
+			return fmt.Sprintf("%v", m)
+		}
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// numbers are compared by value, independent of their type (eg. int and int64)
+func number(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,143 @@
+package diff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func manifest(kind string, name string, data map[interface{}]interface{}) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata":   map[interface{}]interface{}{"name": name, "namespace": "default"},
+		"data":       data,
+	}
+}
+
+func TestResources(t *testing.T) {
+	from := []map[interface{}]interface{}{
+		manifest("ConfigMap", "cm", map[interface{}]interface{}{"a": "1", "b": "2"}),
+		manifest("Secret", "secret", map[interface{}]interface{}{"password": "old"}),
+		manifest("ConfigMap", "removed", nil),
+	}
+	to := []map[interface{}]interface{}{
+		manifest("ConfigMap", "cm", map[interface{}]interface{}{"a": "1", "b": "3", "c": "4"}),
+		manifest("Secret", "secret", map[interface{}]interface{}{"password": "new"}),
+		manifest("ConfigMap", "added", nil),
+	}
+
+	diffs := Resources(from, to, Options{})
+	assert.Len(t, diffs, 4)
+
+	assert.Equal(t, Changed, diffs[0].Type)
+	assert.Equal(t, []FieldChange{
+		{Type: Changed, Path: "data.b", Old: "2", New: "3"},
+		{Type: Added, Path: "data.c", New: "4"},
+	}, diffs[0].Fields)
+
+	assert.Equal(t, []FieldChange{
+		{Type: Changed, Path: "data.password", Old: utils.Redact("old"), New: utils.Redact("new")},
+	}, diffs[1].Fields)
+
+	assert.Equal(t, Removed, diffs[2].Type)
+	assert.Equal(t, "removed", diffs[2].ID.Name)
+	assert.Equal(t, Added, diffs[3].Type)
+	assert.Equal(t, "added", diffs[3].ID.Name)
+
+	var buf bytes.Buffer
+	assert.NoError(t, Print(&buf, diffs[:1]))
+	assert.Equal(t, "~ v1, Kind=ConfigMap default/cm\n    ~ data.b: \"2\" -> \"3\"\n    + data.c: \"4\"\n", buf.String())
+}
+
+func TestResourcesRevealSecretsAndIgnore(t *testing.T) {
+	from := []map[interface{}]interface{}{manifest("Secret", "secret", map[interface{}]interface{}{"password": "old"})}
+	to := []map[interface{}]interface{}{manifest("Secret", "secret", map[interface{}]interface{}{"password": "new"})}
+
+	diffs := Resources(from, to, Options{RevealSecrets: true})
+	assert.Equal(t, "new", diffs[0].Fields[0].New)
+
+	assert.Empty(t, Resources(from, to, Options{IgnorePaths: []string{"data"}}))
+}
+
+func TestResourcesLists(t *testing.T) {
+	container := func(name string, image string) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"name": name, "image": image}
+	}
+	deployment := func(containers ...interface{}) []map[interface{}]interface{} {
+		m := manifest("Deployment", "app", nil)
+		delete(m, "data")
+		m["spec"] = map[interface{}]interface{}{"containers": containers}
+		return []map[interface{}]interface{}{m}
+	}
+
+	tests := []struct {
+		name   string
+		from   []map[interface{}]interface{}
+		to     []map[interface{}]interface{}
+		opts   Options
+		fields []FieldChange
+	}{
+		{
+			name: "appended container",
+			from: deployment(container("app", "app:1")),
+			to:   deployment(container("app", "app:1"), container("sidecar", "proxy:1")),
+			fields: []FieldChange{
+				{Type: Added, Path: "spec.containers[name=sidecar]", New: container("sidecar", "proxy:1")},
+			},
+		},
+		{
+			name: "removed container",
+			from: deployment(container("app", "app:1"), container("sidecar", "proxy:1")),
+			to:   deployment(container("app", "app:1")),
+			opts: Options{DesiredOnly: true},
+			fields: []FieldChange{
+				{Type: Removed, Path: "spec.containers[name=sidecar]", Old: container("sidecar", "proxy:1")},
+			},
+		},
+		{
+			name: "reordered containers",
+			from: deployment(container("app", "app:1"), container("sidecar", "proxy:1")),
+			to:   deployment(container("sidecar", "proxy:2"), container("app", "app:1")),
+			fields: []FieldChange{
+				{Type: Changed, Path: "spec.containers[name=sidecar].image", Old: "proxy:1", New: "proxy:2"},
+			},
+		},
+		{
+			name: "unnamed",
+			from: deployment("a", "b"),
+			to:   deployment("a", "c", "d"),
+			fields: []FieldChange{
+				{Type: Changed, Path: "spec.containers[1]", Old: "b", New: "c"},
+				{Type: Added, Path: "spec.containers[2]", New: "d"},
+			},
+		},
+		{
+			name: "duplicate names",
+			from: deployment(container("app", "app:1"), container("app", "app:2")),
+			to:   deployment(container("app", "app:1")),
+			fields: []FieldChange{
+				{Type: Removed, Path: "spec.containers[1]", Old: container("app", "app:2")},
+			},
+		},
+		{
+			name: "ignored",
+			from: deployment(container("app", "app:1")),
+			to:   deployment(container("app", "app:1"), container("sidecar", "proxy:1")),
+			opts: Options{IgnorePaths: []string{"spec.containers[name=sidecar]"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := Resources(tt.from, tt.to, tt.opts)
+			if tt.fields == nil {
+				assert.Empty(t, diffs)
+				return
+			}
+			assert.Len(t, diffs, 1)
+			assert.Equal(t, tt.fields, diffs[0].Fields)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package diff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bedag/subst/internal/kube"
+	"github.com/bedag/subst/internal/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// Live reads the live state of the given manifests from the cluster. Manifests
+// which do not exist in the cluster (or whose kind is unknown to it, eg.
+// custom resources of CRDs not installed yet) are omitted. The manifests are
+// returned as well, namespaced manifests without namespace get the namespace
+// they were read from, so they match their live copy. Each lookup is bound by
+// the timeout (like --kubectl-timeout, 0 disables it).
+func Live(ctx context.Context, client kube.Resources, manifests []map[interface{}]interface{}, timeout time.Duration) (live []map[interface{}]interface{}, rendered []map[interface{}]interface{}, err error) {
+	rendered = make([]map[interface{}]interface{}, 0, len(manifests))
+	for _, m := range manifests {
+		id := ID(m)
+		obj, err := get(ctx, client, id, timeout)
+		if errors.Is(err, kube.ErrUnknownKind) {
+			log.Warn().Msgf("%s: %s, comparing as not found", id, err)
+			rendered = append(rendered, m)
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get %s: %w", id, err)
+		}
+		if obj == nil {
+			rendered = append(rendered, m)
+			continue
+		}
+		l := utils.ToInterfaceDeep(obj)
+		if ns := ID(l).Namespace; id.Namespace == "" && ns != "" {
+			m = withNamespace(m, ns)
+		}
+		live = append(live, l)
+		rendered = append(rendered, m)
+	}
+	return live, rendered, nil
+}
+
+// reads a single resource within the timeout
+func get(ctx context.Context, client kube.Resources, id ResourceID, timeout time.Duration) (map[string]interface{}, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	obj, err := client.Get(ctx, id.APIVersion, id.Kind, id.Namespace, id.Name)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s: %w", timeout, ctx.Err())
+	}
+	return obj, err
+}
+
+// returns a copy of the manifest with the given namespace
+func withNamespace(manifest map[interface{}]interface{}, namespace string) map[interface{}]interface{} {
+	c := make(map[interface{}]interface{}, len(manifest))
+	for k, v := range manifest {
+		c[k] = v
+	}
+	metadata := map[interface{}]interface{}{}
+	if m, ok := asMap(manifest["metadata"]); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	metadata["namespace"] = namespace
+	c["metadata"] = metadata
+	return c
+}
+
+// LiveOptions returns the options to compare live resources with rendered ones
+func LiveOptions(reveal bool) Options {
+	return Options{
+		RevealSecrets: reveal,
+		IgnorePaths:   kube.ServerManagedFields,
+		DesiredOnly:   true,
+		StringData:    true,
+	}
+}
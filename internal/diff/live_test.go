@@ -0,0 +1,90 @@
+package diff
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bedag/subst/internal/kube"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestLive(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":            "cm",
+			"namespace":       "default",
+			"resourceVersion": "42",
+			"managedFields":   []interface{}{map[string]interface{}{"manager": "kubectl"}},
+		},
+		"data": map[string]interface{}{"a": "1", "b": "2", "defaulted": "x"},
+	}}
+	secret := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": "secret", "namespace": "default"},
+		"data":       map[string]interface{}{"password": "czNjcjN0"},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+			{Version: "v1", Resource: "secrets"}:    "SecretList",
+		}, existing, secret)
+
+	unknown := manifest("ConfigMap", "unknown", nil)
+	unknown["apiVersion"] = "example.com/v1"
+	// namespaced manifests without namespace are read from the default namespace
+	unchanged := manifest("Secret", "secret", nil)
+	delete(unchanged["metadata"].(map[interface{}]interface{}), "namespace")
+	delete(unchanged, "data")
+	unchanged["stringData"] = map[interface{}]interface{}{"password": "s3cr3t"}
+	rendered := []map[interface{}]interface{}{
+		manifest("ConfigMap", "cm", map[interface{}]interface{}{"a": "1", "b": "3"}),
+		manifest("ConfigMap", "missing", nil),
+		unknown,
+		unchanged,
+	}
+
+	live, normalized, err := Live(context.Background(), kube.NewResourcesFromClient(client, mapper), rendered, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, live, 2)
+	assert.Len(t, normalized, len(rendered))
+	assert.Equal(t, ResourceID{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "secret"}, ID(normalized[3]))
+	assert.Equal(t, "", ID(rendered[3]).Namespace)
+
+	diffs := Resources(live, normalized, LiveOptions(false))
+	assert.Len(t, diffs, 3)
+	assert.Equal(t, Changed, diffs[0].Type)
+	assert.Equal(t, []FieldChange{{Type: Changed, Path: "data.b", Old: "2", New: "3"}}, diffs[0].Fields)
+	assert.Equal(t, Added, diffs[1].Type)
+	assert.Equal(t, "missing", diffs[1].ID.Name)
+	assert.Equal(t, Added, diffs[2].Type)
+	assert.Equal(t, "example.com/v1", diffs[2].ID.APIVersion)
+}
+
+// resources which only answer once the context is done
+type blockingResources struct{}
+
+func (blockingResources) Get(ctx context.Context, apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLiveTimeout(t *testing.T) {
+	start := time.Now()
+	_, _, err := Live(context.Background(), blockingResources{}, []map[interface{}]interface{}{manifest("ConfigMap", "cm", nil)}, 50*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "failed to get v1, Kind=ConfigMap default/cm: timed out after 50ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,102 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultNamespace = "default"
+)
+
+// Fields which are managed by the API server and should not be
+// considered when comparing resources
+var ServerManagedFields = []string{
+	"status",
+	"metadata.managedFields",
+	"metadata.resourceVersion",
+	"metadata.uid",
+	"metadata.generation",
+	"metadata.creationTimestamp",
+	"metadata.selfLink",
+	"metadata.annotations.kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// Config creates a client configuration from a kubeconfig path and/or API url.
+// Without both, the in-cluster configuration is used.
+func Config(kubeconfig string, host string) (*rest.Config, error) {
+	return clientcmd.BuildConfigFromFlags(host, kubeconfig)
+}
+
+// ErrUnknownKind is returned for resources whose kind can not be mapped to
+// an API resource (eg. the CRD is not installed or discovery failed)
+var ErrUnknownKind = errors.New("unknown kind")
+
+// Resources reads arbitrary resources from a cluster
+type Resources interface {
+	// Get returns the live state of the given resource, nil if the resource does not exist
+	Get(ctx context.Context, apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error)
+}
+
+type dynamicResources struct {
+	client dynamic.Interface
+	mapper meta.RESTMapper
+}
+
+// NewResources creates a Resources client for the given configuration
+func NewResources(cfg *rest.Config) (Resources, error) {
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc))
+	return NewResourcesFromClient(client, mapper), nil
+}
+
+// NewResourcesFromClient creates a Resources client from existing clients (eg. fake clients)
+func NewResourcesFromClient(client dynamic.Interface, mapper meta.RESTMapper) Resources {
+	return &dynamicResources{client: client, mapper: mapper}
+}
+
+func (r *dynamicResources) Get(ctx context.Context, apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := r.mapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s %s: %s", ErrUnknownKind, apiVersion, kind, err)
+	}
+
+	var ri dynamic.ResourceInterface = r.client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if namespace == "" {
+			namespace = defaultNamespace
+		}
+		ri = r.client.Resource(mapping.Resource).Namespace(namespace)
+	}
+
+	obj, err := ri.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return obj.Object, nil
+}
@@ -0,0 +1,79 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestGet(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+			{Version: "v1", Resource: "namespaces"}: "NamespaceList",
+		},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "cm", "namespace": "default"},
+		}},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "cm", "namespace": "app"},
+		}},
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata":   map[string]interface{}{"name": "app"},
+		}},
+	)
+	resources := NewResourcesFromClient(client, mapper)
+
+	tests := []struct {
+		name       string
+		apiVersion string
+		kind       string
+		namespace  string
+		resource   string
+		found      string
+		missing    bool
+		err        error
+	}{
+		{name: "namespaced", apiVersion: "v1", kind: "ConfigMap", namespace: "app", resource: "cm", found: "app"},
+		{name: "default namespace", apiVersion: "v1", kind: "ConfigMap", resource: "cm", found: "default"},
+		{name: "cluster scoped", apiVersion: "v1", kind: "Namespace", namespace: "ignored", resource: "app", found: ""},
+		{name: "missing", apiVersion: "v1", kind: "ConfigMap", namespace: "app", resource: "missing", missing: true},
+		{name: "unknown kind", apiVersion: "example.com/v1", kind: "Bucket", resource: "bucket", err: ErrUnknownKind},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := resources.Get(context.Background(), tt.apiVersion, tt.kind, tt.namespace, tt.resource)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.missing {
+				assert.Nil(t, obj)
+				return
+			}
+			u := unstructured.Unstructured{Object: obj}
+			assert.Equal(t, tt.resource, u.GetName())
+			assert.Equal(t, tt.found, u.GetNamespace())
+		})
+	}
+
+	_, err := resources.Get(context.Background(), "example.com/v1/invalid", "Bucket", "", "bucket")
+	assert.Error(t, err)
+}
@@ -5,7 +5,6 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"sync"
 
 	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/api/resmap"
@@ -17,6 +16,8 @@ type Kustomize struct {
 	Root  string
 	Paths []string
 	Build resmap.ResMap
+	// directory the build is confined to, unrestricted if empty
+	sandbox string
 }
 
 func NewKustomize(root string) (*Kustomize, error) {
@@ -33,13 +34,44 @@ func NewKustomize(root string) (*Kustomize, error) {
 	return k, nil
 }
 
-var kustomizeBuildMutex sync.Mutex
+// NewSandboxedKustomize builds the root confined to the sandbox directory (eg.
+// an uploaded archive): files are only loaded from within their kustomization
+// root, references outside of the sandbox and remote references are rejected
+// and only builtin plugins are enabled
+func NewSandboxedKustomize(root string, sandbox string) (*Kustomize, error) {
+	sandbox, err := filepath.Abs(sandbox)
+	if err != nil {
+		return nil, err
+	}
+	k := &Kustomize{Root: root, sandbox: sandbox}
+	if err := within(sandbox, root); err != nil {
+		return nil, err
+	}
+	if err := k.confine(root, map[string]bool{}); err != nil {
+		return nil, err
+	}
+	if err := k.build(); err != nil {
+		return nil, err
+	}
+	if err := k.paths(root); err != nil {
+		return nil, err
+	}
+	if err := k.addPath(root); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
 
 func (k *Kustomize) addPath(path string) error {
 	p, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
+	if k.sandbox != "" {
+		if err := within(k.sandbox, p); err != nil {
+			return err
+		}
+	}
 	for _, v := range k.Paths {
 		if v == p {
 			return nil
@@ -103,10 +135,20 @@ func (k *Kustomize) Walk(fn func(path string, f fs.FileInfo) error) error {
 }
 
 func (k *Kustomize) build() (err error) {
-	fs := filesys.MakeFsOnDisk()
-
-	kustomizeBuildMutex.Lock()
-	defer kustomizeBuildMutex.Unlock()
+	var fs filesys.FileSystem = filesys.MakeFsOnDisk()
+	buildOptions := &krusty.Options{
+		LoadRestrictions: kustypes.LoadRestrictionsNone,
+		PluginConfig:     kustypes.EnabledPluginConfig(kustypes.BuiltinPluginLoadingOptions(kustypes.PluginRestrictionsNone)),
+	}
+	if k.sandbox != "" {
+		if fs, err = newConfinedFs(k.sandbox); err != nil {
+			return err
+		}
+		buildOptions = &krusty.Options{
+			LoadRestrictions: kustypes.LoadRestrictionsRootOnly,
+			PluginConfig:     kustypes.DisabledPluginConfig(),
+		}
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -114,11 +156,6 @@ func (k *Kustomize) build() (err error) {
 		}
 	}()
 
-	buildOptions := &krusty.Options{
-		LoadRestrictions: kustypes.LoadRestrictionsNone,
-		PluginConfig:     kustypes.EnabledPluginConfig(kustypes.BuiltinPluginLoadingOptions(kustypes.PluginRestrictionsNone)),
-	}
-
 	b := krusty.MakeKustomizer(buildOptions)
 
 	k.Build, err = b.Run(fs, k.Root)
@@ -0,0 +1,214 @@
+package kustomize
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// confinedFs is a read-only filesystem limited to a directory (eg. an
+// uploaded archive), paths outside of it do not exist. Links are not
+// resolved, the directory must not contain any.
+type confinedFs struct {
+	filesys.FileSystem
+	dir string
+}
+
+func newConfinedFs(dir string) (*confinedFs, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &confinedFs{FileSystem: filesys.MakeFsOnDisk(), dir: dir}, nil
+}
+
+// returns an error if the path is not within the directory
+func (c *confinedFs) within(path string) error {
+	return within(c.dir, path)
+}
+
+func within(dir string, path string) error {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", path, dir)
+	}
+	return nil
+}
+
+func (c *confinedFs) Create(path string) (filesys.File, error) {
+	return nil, fmt.Errorf("can not create %s, filesystem is read-only", path)
+}
+
+func (c *confinedFs) Mkdir(path string) error {
+	return fmt.Errorf("can not create %s, filesystem is read-only", path)
+}
+
+func (c *confinedFs) MkdirAll(path string) error {
+	return fmt.Errorf("can not create %s, filesystem is read-only", path)
+}
+
+func (c *confinedFs) RemoveAll(path string) error {
+	return fmt.Errorf("can not remove %s, filesystem is read-only", path)
+}
+
+func (c *confinedFs) WriteFile(path string, data []byte) error {
+	return fmt.Errorf("can not write %s, filesystem is read-only", path)
+}
+
+func (c *confinedFs) Open(path string) (filesys.File, error) {
+	if err := c.within(path); err != nil {
+		return nil, err
+	}
+	return c.FileSystem.Open(path)
+}
+
+func (c *confinedFs) IsDir(path string) bool {
+	return c.within(path) == nil && c.FileSystem.IsDir(path)
+}
+
+func (c *confinedFs) ReadDir(path string) ([]string, error) {
+	if err := c.within(path); err != nil {
+		return nil, err
+	}
+	return c.FileSystem.ReadDir(path)
+}
+
+func (c *confinedFs) CleanedAbs(path string) (filesys.ConfirmedDir, string, error) {
+	if err := c.within(path); err != nil {
+		return "", "", err
+	}
+	return c.FileSystem.CleanedAbs(path)
+}
+
+func (c *confinedFs) Exists(path string) bool {
+	return c.within(path) == nil && c.FileSystem.Exists(path)
+}
+
+func (c *confinedFs) Glob(pattern string) ([]string, error) {
+	matches, err := c.FileSystem.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var confined []string
+	for _, match := range matches {
+		if c.within(match) == nil {
+			confined = append(confined, match)
+		}
+	}
+	return confined, nil
+}
+
+func (c *confinedFs) ReadFile(path string) ([]byte, error) {
+	if err := c.within(path); err != nil {
+		return nil, err
+	}
+	return c.FileSystem.ReadFile(path)
+}
+
+func (c *confinedFs) Walk(path string, walkFn filepath.WalkFunc) error {
+	if err := c.within(path); err != nil {
+		return err
+	}
+	return c.FileSystem.Walk(path, walkFn)
+}
+
+// checks that the files and directories referenced by the kustomization in
+// path (and the kustomizations it references) exist within the sandbox.
+// kustomize fetches references it can not find locally (eg. git
+// repositories or URLs), these are rejected before the build.
+func (k *Kustomize) confine(path string, visited map[string]bool) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if visited[path] {
+		return nil
+	}
+	visited[path] = true
+
+	kz, err := kustomizeFile(path)
+	if err != nil {
+		return err
+	}
+
+	var refs []string
+	refs = append(refs, kz.Resources...)
+	refs = append(refs, kz.Bases...)
+	refs = append(refs, kz.Components...)
+	refs = append(refs, kz.Crds...)
+	refs = append(refs, kz.Configurations...)
+	refs = append(refs, kz.Generators...)
+	refs = append(refs, kz.Transformers...)
+	refs = append(refs, kz.Validators...)
+	if p := kz.OpenAPI["path"]; p != "" {
+		refs = append(refs, p)
+	}
+	for _, patch := range kz.Patches {
+		refs = append(refs, patch.Path)
+	}
+	for _, patch := range kz.PatchesJson6902 {
+		refs = append(refs, patch.Path)
+	}
+	for _, patch := range kz.PatchesStrategicMerge {
+		// Inline patches span multiple lines
+		if !strings.Contains(string(patch), "\n") {
+			refs = append(refs, string(patch))
+		}
+	}
+	for _, replacement := range kz.Replacements {
+		refs = append(refs, replacement.Path)
+	}
+	for _, generator := range kz.ConfigMapGenerator {
+		refs = append(refs, generatorFiles(generator.KvPairSources)...)
+	}
+	for _, generator := range kz.SecretGenerator {
+		refs = append(refs, generatorFiles(generator.KvPairSources)...)
+	}
+
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		p := ref
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(path, ref)
+		}
+		if err := within(k.sandbox, p); err != nil {
+			return fmt.Errorf("%s references %s: %w", path, ref, err)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("%s references %s, which does not exist (remote references are not supported)", path, ref)
+		}
+		if info.IsDir() {
+			if _, err := kustomizeFile(p); err == nil {
+				if err := k.confine(p, visited); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// returns the paths of the file sources ([<key>=]<path>) and env sources of
+// a generator
+func generatorFiles(sources types.KvPairSources) []string {
+	var paths []string
+	for _, file := range sources.FileSources {
+		if _, p, found := strings.Cut(file, "="); found {
+			file = p
+		}
+		paths = append(paths, file)
+	}
+	paths = append(paths, sources.EnvSources...)
+	return append(paths, sources.EnvSource)
+}
@@ -0,0 +1,89 @@
+package kustomize
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+}
+
+func TestSandboxedKustomize(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		root  string
+		err   string
+	}{
+		{
+			name: "confined",
+			files: map[string]string{
+				"app/kustomization.yaml":  "resources:\n  - ../base\nconfigMapGenerator:\n  - name: app\n    files: [config=app.conf]\n",
+				"app/app.conf":            "key=value\n",
+				"base/kustomization.yaml": "resources:\n  - cm.yaml\n",
+				"base/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: base\n",
+			},
+		},
+		{
+			name:  "host file",
+			files: map[string]string{"app/kustomization.yaml": "configMapGenerator:\n  - name: host\n    files: [/etc/hostname]\n"},
+			err:   "outside of",
+		},
+		{
+			name:  "parent file",
+			files: map[string]string{"app/kustomization.yaml": "configMapGenerator:\n  - name: host\n    envs: [../../hostname]\n"},
+			err:   "outside of",
+		},
+		{
+			name:  "remote",
+			files: map[string]string{"app/kustomization.yaml": "resources:\n  - https://github.com/bedag/subst//examples/01-simple\n"},
+			err:   "remote references are not supported",
+		},
+		{
+			name:  "outside",
+			files: map[string]string{"app/kustomization.yaml": "resources:\n  - ../../../etc\n"},
+			err:   "outside of",
+		},
+		{
+			name: "nested",
+			files: map[string]string{
+				"app/kustomization.yaml":  "resources:\n  - ../base\n",
+				"base/kustomization.yaml": "patches:\n  - path: ../../patch.yaml\n",
+			},
+			err: "outside of",
+		},
+		{
+			name:  "root",
+			files: map[string]string{"app/kustomization.yaml": "resources: []\n"},
+			root:  "..",
+			err:   "outside of",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sandbox := filepath.Join(dir, "sandbox")
+			writeFiles(t, sandbox, tt.files)
+			root := filepath.Join(sandbox, "app")
+			if tt.root != "" {
+				root = filepath.Join(sandbox, tt.root)
+			}
+
+			k, err := NewSandboxedKustomize(root, sandbox)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 2, k.Build.Size())
+		})
+	}
+}
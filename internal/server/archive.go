@@ -0,0 +1,84 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extracts a tar.gz archive to dir. Entries must stay within dir, symlinks are
+// not supported and the extracted files are limited to maxSize bytes.
+func extract(r io.Reader, dir string, maxSize int64) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	defer gz.Close()
+
+	remaining := maxSize
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid archive: %w", err)
+		}
+
+		target, err := within(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if header.Size > remaining {
+				return fmt.Errorf("archive exceeds the maximum size of %d bytes", maxSize)
+			}
+			remaining -= header.Size
+			if err := writeFile(target, archive, header.Size); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("archive entry %s: links are not supported", header.Name)
+		default:
+			// Other entries (eg. pax headers) are skipped
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	return f.Close()
+}
+
+// resolves the relative path within dir, paths leaving dir are rejected
+func within(dir string, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("path %s must be relative", name)
+	}
+	target := filepath.Join(dir, name)
+	if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside of the archive", name)
+	}
+	return target, nil
+}
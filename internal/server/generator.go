@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/rs/zerolog/log"
+)
+
+// GeneratorPath is the endpoint of the Argo CD ApplicationSet plugin
+// generator protocol
+const GeneratorPath = "/api/v1/getparams.execute"
+
+// request of the plugin generator, the input parameters are configured in the
+// ApplicationSet:
+//
+//	generators:
+//	  - plugin:
+//	      configMapRef:
+//	        name: subst-generator
+//	      input:
+//	        parameters:
+//	          path: clusters/*
+//	          keys: [cluster, region]
+type generatorRequest struct {
+	ApplicationSetName string `json:"applicationSetName"`
+	Input              struct {
+		Parameters generatorParameters `json:"parameters"`
+	} `json:"input"`
+}
+
+type generatorParameters struct {
+	// Glob of the directories within the generator root
+	Path string `json:"path"`
+	// Substitution keys (dot separated for nested keys) added to the
+	// parameter sets
+	Keys []string `json:"keys"`
+	// Environment variables applied on top of the environment of the server
+	Env map[string]string `json:"env"`
+}
+
+type generatorResponse struct {
+	Output struct {
+		Parameters []map[string]interface{} `json:"parameters"`
+	} `json:"output"`
+}
+
+// kustomize recognized kustomization files, directories without one are
+// not generated
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// returns one parameter set per directory matching the path glob, with the
+// path of the directory (path, path.basename) and the selected substitutions
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) int {
+	token := s.cfg.GeneratorToken
+	if token == "" {
+		token = s.cfg.Token
+	}
+	if !s.authorized(r, token) {
+		return unauthorized(w)
+	}
+
+	var req generatorRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(&req); err != nil {
+		return writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+	}
+	params := req.Input.Parameters
+	if params.Path == "" {
+		return writeError(w, http.StatusBadRequest, fmt.Errorf("input parameter path is required"))
+	}
+	if len(params.Keys) == 0 {
+		return writeError(w, http.StatusBadRequest, fmt.Errorf("input parameter keys is required"))
+	}
+
+	dirs, err := s.directories(params.Path)
+	if err != nil {
+		return writeError(w, http.StatusBadRequest, err)
+	}
+
+	var resp generatorResponse
+	resp.Output.Parameters = []map[string]interface{}{}
+	for _, dir := range dirs {
+		set, err := s.parameters(r, dir, params)
+		if err != nil {
+			log.Error().Err(err).Str("applicationSet", req.ApplicationSetName).Msgf("failed to generate %s", dir)
+			return writeError(w, http.StatusUnprocessableEntity, err)
+		}
+		resp.Output.Parameters = append(resp.Output.Parameters, set)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(resp)
+	return http.StatusOK
+}
+
+// returns the kustomization directories matching the glob, relative to the
+// generator root
+func (s *Server) directories(glob string) ([]string, error) {
+	if _, err := within(s.cfg.GeneratorRoot, glob); err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(s.cfg.GeneratorRoot, glob))
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %s: %w", glob, err)
+	}
+
+	var dirs []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || !info.IsDir() {
+			continue
+		}
+		for _, name := range kustomizationFiles {
+			if _, err := os.Stat(filepath.Join(match, name)); err == nil {
+				rel, err := filepath.Rel(s.cfg.GeneratorRoot, match)
+				if err != nil {
+					return nil, err
+				}
+				dirs = append(dirs, filepath.ToSlash(rel))
+				break
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// builds the substitutions of the directory and selects the keys
+func (s *Server) parameters(r *http.Request, dir string, params generatorParameters) (map[string]interface{}, error) {
+	cfg := s.cfg.Configuration
+	cfg.RootDirectory = filepath.Join(s.cfg.GeneratorRoot, dir)
+	cfg.Output = "json"
+	cfg.CacheDir = ""
+	env, err := requestEnv(cfg, params.Env)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Env = env
+
+	m, err := subst.New(r.Context(), cfg, subst.WithKubeClient(s.client), subst.WithKeyCache(s.keys))
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	if err := m.BuildSubstitutions(r.Context()); err != nil {
+		return nil, err
+	}
+
+	// The substitutions are converted with the JSON output, so values are
+	// encoded the same way as by 'subst substitutions --output json'
+	var out bytes.Buffer
+	if err := m.WriteSubstitutions(&out); err != nil {
+		return nil, err
+	}
+	substitutions := map[string]interface{}{}
+	if out.Len() > 0 {
+		if err := json.Unmarshal(out.Bytes(), &substitutions); err != nil {
+			return nil, err
+		}
+	}
+
+	set := map[string]interface{}{
+		"path":          dir,
+		"path.basename": filepath.Base(dir),
+	}
+	for _, key := range params.Keys {
+		value, ok := lookup(substitutions, key)
+		if !ok {
+			return nil, &utils.SourceError{
+				File:    dir,
+				Path:    "$.subst." + key,
+				Message: "substitution not found",
+			}
+		}
+		set[key] = value
+	}
+	return set, nil
+}
+
+// looks up the dot separated key
+func lookup(data map[string]interface{}, key string) (interface{}, bool) {
+	var value interface{} = data
+	for _, segment := range strings.Split(key, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
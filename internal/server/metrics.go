@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// request metrics, exposed in the Prometheus text format
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[string]uint64 // by endpoint and status code
+	durations map[string]float64
+	counts    map[string]uint64
+	inFlight  int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[string]uint64),
+		durations: make(map[string]float64),
+		counts:    make(map[string]uint64),
+	}
+}
+
+func (m *metrics) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+}
+
+func (m *metrics) done(endpoint string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.requests[fmt.Sprintf(`endpoint=%q,code="%d"`, endpoint, code)]++
+	m.durations[endpoint] += duration.Seconds()
+	m.counts[endpoint]++
+}
+
+func (m *metrics) write(w io.Writer, hits uint64, misses uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP subst_requests_total Handled requests by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE subst_requests_total counter")
+	for _, labels := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "subst_requests_total{%s} %d\n", labels, m.requests[labels])
+	}
+
+	fmt.Fprintln(w, "# HELP subst_request_duration_seconds Duration of handled requests by endpoint.")
+	fmt.Fprintln(w, "# TYPE subst_request_duration_seconds summary")
+	for _, endpoint := range sortedKeys(m.counts) {
+		fmt.Fprintf(w, "subst_request_duration_seconds_sum{endpoint=%q} %g\n", endpoint, m.durations[endpoint])
+		fmt.Fprintf(w, "subst_request_duration_seconds_count{endpoint=%q} %d\n", endpoint, m.counts[endpoint])
+	}
+
+	fmt.Fprintln(w, "# HELP subst_requests_in_flight Requests currently handled.")
+	fmt.Fprintln(w, "# TYPE subst_requests_in_flight gauge")
+	fmt.Fprintf(w, "subst_requests_in_flight %d\n", m.inFlight)
+
+	fmt.Fprintln(w, "# HELP subst_key_cache_hits_total Key lookups served from the key cache.")
+	fmt.Fprintln(w, "# TYPE subst_key_cache_hits_total counter")
+	fmt.Fprintf(w, "subst_key_cache_hits_total %d\n", hits)
+	fmt.Fprintln(w, "# HELP subst_key_cache_misses_total Key lookups read from Kubernetes Secrets.")
+	fmt.Fprintln(w, "# TYPE subst_key_cache_misses_total counter")
+	fmt.Fprintf(w, "subst_key_cache_misses_total %d\n", misses)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
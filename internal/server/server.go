@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultMaxArchiveSize is the default limit of uploaded archives
+	DefaultMaxArchiveSize int64 = 32 << 20
+	// DefaultMaxExtractedSize is the default limit of the extracted files
+	DefaultMaxExtractedSize int64 = 128 << 20
+)
+
+// Config configures the render server
+type Config struct {
+	// Configuration of the renders, the environment and application of a
+	// request are applied on top
+	Configuration config.Configuration
+	// Maximum size of the uploaded request
+	MaxArchiveSize int64
+	// Maximum size of the files extracted from the archive
+	MaxExtractedSize int64
+	// Directory (eg. a repository checkout) of the ApplicationSet plugin
+	// generator, the generator is disabled if empty
+	GeneratorRoot string
+	// Token of the plugin generator requests, defaults to Token
+	GeneratorToken string
+	// Bearer token of the requests, requests with a verified client
+	// certificate (mTLS) are authorized without token. Requests are
+	// rejected if neither is configured.
+	Token string
+	// Namespace of the Secrets of the applications. If set, requests must name
+	// their application and are decrypted with the keys of its Secret (derived
+	// like ARGOCD_APP_NAME) instead of the Secrets configured for the server.
+	AppSecretNamespace string
+}
+
+// Valid application names (Argo CD applications, optionally prefixed with
+// their project)
+var appRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]{0,251}[a-zA-Z0-9])?$`)
+
+// Server renders uploaded applications over HTTP. Decryption keys are kept in
+// the key cache between requests.
+type Server struct {
+	cfg     Config
+	keys    *subst.KeyCache
+	client  kubernetes.Interface
+	metrics *metrics
+}
+
+// New creates a server. The client is used to read Secrets and ConfigMaps, if
+// nil a client is created from the configuration for each render.
+func New(cfg Config, keys *subst.KeyCache, client kubernetes.Interface) *Server {
+	if cfg.MaxArchiveSize <= 0 {
+		cfg.MaxArchiveSize = DefaultMaxArchiveSize
+	}
+	if cfg.MaxExtractedSize <= 0 {
+		cfg.MaxExtractedSize = DefaultMaxExtractedSize
+	}
+	return &Server{
+		cfg:     cfg,
+		keys:    keys,
+		client:  client,
+		metrics: newMetrics(),
+	}
+}
+
+// Handler returns the handler of the server endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /render", s.instrument("render", func(w http.ResponseWriter, r *http.Request) int {
+		return s.serve(w, r, false)
+	}))
+	mux.HandleFunc("POST /substitutions", s.instrument("substitutions", func(w http.ResponseWriter, r *http.Request) int {
+		return s.serve(w, r, true)
+	}))
+	if s.cfg.GeneratorRoot != "" {
+		mux.HandleFunc("POST "+GeneratorPath, s.instrument("generator", s.generate))
+	}
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		var hits, misses uint64
+		if s.keys != nil {
+			hits, misses = s.keys.Stats()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.write(w, hits, misses)
+	})
+	return mux
+}
+
+func (s *Server) instrument(endpoint string, handler func(http.ResponseWriter, *http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		s.metrics.start()
+		code := handler(w, r)
+		s.metrics.done(endpoint, code, time.Since(start))
+		log.Debug().Str("endpoint", endpoint).Int("code", code).Msgf("request handled in %s", time.Since(start))
+	}
+}
+
+// renders the uploaded application, returns the status code of the response
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, substitutions bool) int {
+	if !s.authorized(r, s.cfg.Token) {
+		return unauthorized(w)
+	}
+
+	dir, err := os.MkdirTemp("", "subst-serve-")
+	if err != nil {
+		return writeError(w, http.StatusInternalServerError, err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := s.request(r, dir)
+	if err != nil {
+		return writeError(w, http.StatusBadRequest, err)
+	}
+
+	var out bytes.Buffer
+	if err := s.render(r.Context(), cfg, &out, substitutions); err != nil {
+		log.Error().Err(err).Msg("render failed")
+		return writeError(w, http.StatusUnprocessableEntity, err)
+	}
+
+	if cfg.Output == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/yaml")
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, &out)
+	return http.StatusOK
+}
+
+// reports if the request has a verified client certificate or the bearer
+// token
+func (s *Server) authorized(r *http.Request, token string) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if token == "" {
+		return false
+	}
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+func unauthorized(w http.ResponseWriter) int {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	return writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+}
+
+// returns the environment of the server with the variables of the request
+// applied on top, the request may only set variables matching the env regex
+func requestEnv(cfg config.Configuration, values map[string]string) (map[string]string, error) {
+	regex, err := regexp.Compile(cfg.EnvRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env regex: %w", err)
+	}
+	env := make(map[string]string, len(cfg.Env)+len(values))
+	for k, v := range cfg.Env {
+		env[k] = v
+	}
+	for k, v := range values {
+		if !regex.MatchString(k) {
+			return nil, fmt.Errorf("environment variable %s is not allowed (must match %s)", k, cfg.EnvRegex)
+		}
+		env[k] = v
+	}
+	return env, nil
+}
+
+// reads the multipart request, extracts its archive to dir and returns the
+// configuration of the render. The render is confined to dir, the Secret
+// holding the decryption keys is the one of the application (see
+// AppSecretNamespace) or the one configured for the server.
+func (s *Server) request(r *http.Request, dir string) (config.Configuration, error) {
+	cfg := s.cfg.Configuration
+	r.Body = http.MaxBytesReader(nil, r.Body, s.cfg.MaxArchiveSize)
+	if err := r.ParseMultipartForm(s.cfg.MaxArchiveSize); err != nil {
+		return cfg, fmt.Errorf("invalid request: %w", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	archive, _, err := r.FormFile("archive")
+	if err != nil {
+		return cfg, fmt.Errorf("invalid archive: %w", err)
+	}
+	defer archive.Close()
+	if err := extract(archive, dir, s.cfg.MaxExtractedSize); err != nil {
+		return cfg, err
+	}
+
+	root, err := within(dir, r.FormValue("path"))
+	if err != nil {
+		return cfg, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return cfg, fmt.Errorf("path %s not found in archive", r.FormValue("path"))
+	}
+	cfg.RootDirectory = root
+	cfg.Sandbox = dir
+
+	var values map[string]string
+	if value := r.FormValue("env"); value != "" {
+		if err := json.Unmarshal([]byte(value), &values); err != nil {
+			return cfg, fmt.Errorf("invalid env (expected JSON object of strings): %w", err)
+		}
+	}
+	if cfg.Env, err = requestEnv(cfg, values); err != nil {
+		return cfg, err
+	}
+	if err := s.appSecret(&cfg, r.FormValue("app")); err != nil {
+		return cfg, err
+	}
+
+	if output := r.FormValue("output"); output != "" {
+		cfg.Output = output
+	}
+	if cfg.Output != "" && cfg.Output != "yaml" && cfg.Output != "json" {
+		return cfg, fmt.Errorf("invalid output format %q (supported: yaml, json)", cfg.Output)
+	}
+	cfg.CacheDir = ""
+	return cfg, nil
+}
+
+// selects the Secret of the application within AppSecretNamespace, the
+// Secrets configured for the server are not used for applications
+func (s *Server) appSecret(cfg *config.Configuration, app string) error {
+	if s.cfg.AppSecretNamespace == "" {
+		if app != "" {
+			return fmt.Errorf("app is not supported by this server (see --app-secret-namespace)")
+		}
+		return nil
+	}
+	if app == "" {
+		return fmt.Errorf("app is required")
+	}
+	if !appRegex.MatchString(app) {
+		return fmt.Errorf("invalid app %q", app)
+	}
+
+	cfg.Env["ARGOCD_APP_NAME"] = app
+	cfg.SecretName = ""
+	cfg.SecretNamespace = s.cfg.AppSecretNamespace
+	cfg.Secrets = nil
+	cfg.SecretSelector = ""
+	cfg.SecretSkip = false
+	return cfg.ResolveSecret()
+}
+
+func (s *Server) render(ctx context.Context, cfg config.Configuration, w io.Writer, substitutions bool) error {
+	m, err := subst.New(ctx, cfg, subst.WithKubeClient(s.client), subst.WithKeyCache(s.keys))
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.BuildSubstitutions(ctx); err != nil {
+		return err
+	}
+	if substitutions {
+		return m.WriteSubstitutions(w)
+	}
+	if err := m.Build(ctx); err != nil {
+		return err
+	}
+	return m.Write(w)
+}
+
+// writes the errors as JSON, the same format as --error-format json
+func writeError(w http.ResponseWriter, code int, err error) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": utils.ErrorList(err),
+	})
+	return code
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for name, content := range files {
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := archive.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+const testToken = "token"
+
+func post(t *testing.T, url string, archive []byte, fields map[string]string) *http.Response {
+	return postWithToken(t, url, testToken, archive, fields)
+}
+
+func postWithToken(t *testing.T, url string, token string, archive []byte, fields map[string]string) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for k, v := range fields {
+		assert.NoError(t, form.WriteField(k, v))
+	}
+	part, err := form.CreateFormFile("archive", "app.tar.gz")
+	assert.NoError(t, err)
+	_, err = part.Write(archive)
+	assert.NoError(t, err)
+	assert.NoError(t, form.Close())
+
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func read(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestServer(t *testing.T) {
+	cfg := subst.DefaultConfiguration()
+	cfg.SkipDecrypt = true
+	srv := httptest.NewServer(New(Config{Configuration: cfg, Token: testToken}, subst.NewKeyCache(0), nil).Handler())
+	defer srv.Close()
+
+	archive := testArchive(t, map[string]string{
+		"app/kustomization.yaml": "resources:\n  - cm.yaml\n",
+		"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: (( grab subst.CLUSTER ))\n",
+		"app/subst.yaml":         "other: value\n",
+	})
+
+	resp := post(t, srv.URL+"/render", archive, map[string]string{
+		"path": "app",
+		"env":  `{"ARGOCD_ENV_CLUSTER": "cluster-01"}`,
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: cluster-01\n", read(t, resp))
+
+	resp = post(t, srv.URL+"/substitutions", archive, map[string]string{
+		"path":   "app",
+		"env":    `{"ARGOCD_ENV_CLUSTER": "cluster-02"}`,
+		"output": "json",
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body := read(t, resp)
+	assert.Contains(t, body, `"CLUSTER": "cluster-02"`)
+	assert.Contains(t, body, `"other": "value"`)
+
+	// Missing substitution
+	resp = post(t, srv.URL+"/render", archive, map[string]string{"path": "app"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	var errs struct {
+		Errors []map[string]interface{} `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(read(t, resp)), &errs))
+	assert.NotEmpty(t, errs.Errors)
+
+	// Variables not matching the env regex
+	resp = post(t, srv.URL+"/render", archive, map[string]string{
+		"path": "app",
+		"env":  `{"ARGOCD_APP_NAME": "other"}`,
+	})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	resp = postWithToken(t, srv.URL+"/render", "invalid", archive, map[string]string{"path": "app"})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok\n", read(t, resp))
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	assert.NoError(t, err)
+	metrics := read(t, resp)
+	assert.Contains(t, metrics, `subst_requests_total{endpoint="render",code="200"} 1`)
+	assert.Contains(t, metrics, `subst_requests_total{endpoint="render",code="422"} 1`)
+	assert.Contains(t, metrics, `subst_request_duration_seconds_count{endpoint="substitutions"} 1`)
+	assert.Contains(t, metrics, "subst_requests_in_flight 0")
+}
+
+func TestSandbox(t *testing.T) {
+	// Requests can not read variables of the server process
+	t.Setenv("VAULT_TOKEN", "process-token")
+	cfg := subst.DefaultConfiguration()
+	cfg.SkipDecrypt = true
+	cfg.AllowSubstFrom = []string{"configMap:kube-system/*"}
+	srv := httptest.NewServer(New(Config{Configuration: cfg, Token: testToken}, nil, nil).Handler())
+	defer srv.Close()
+
+	for name, files := range map[string]map[string]string{
+		"host file":   {"app/kustomization.yaml": "configMapGenerator:\n  - name: host\n    files: [/etc/hostname]\n"},
+		"parent file": {"app/kustomization.yaml": "configMapGenerator:\n  - name: host\n    files: [../hostname]\n", "hostname": "host\n"},
+		"remote":      {"app/kustomization.yaml": "resources:\n  - https://github.com/bedag/subst//examples/01-simple\n"},
+		"outside":     {"app/kustomization.yaml": "resources:\n  - ../../../etc\n"},
+		"subst from":  {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "substFrom:\n  - secret: kube-system/credentials\n"},
+		"file":        {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "host: (( file \"/etc/hostname\" ))\n"},
+		"vault":       {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "password: (( vault \"secret/data/app:password\" ))\n"},
+		"manifest file": {
+			"app/kustomization.yaml": "resources:\n  - cm.yaml\n",
+			"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: (( file \"/etc/passwd\" ))\n",
+		},
+		"manifest load": {
+			"app/kustomization.yaml": "resources:\n  - cm.yaml\n",
+			"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: (( load \"http://169.254.169.254/latest/meta-data\" ))\n",
+		},
+		"manifest env": {
+			"app/kustomization.yaml": "resources:\n  - cm.yaml\n",
+			"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: (( concat \"x-\" $VAULT_TOKEN ))\n",
+		},
+		"env":           {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "token: (( grab $VAULT_TOKEN || \"none\" ))\n"},
+		"env reference": {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "token: (( grab subst.$VAULT_TOKEN ))\n"},
+		"template env":  {"app/kustomization.yaml": "resources: []\n", "app/subst.yaml": "token: {{ env \"VAULT_TOKEN\" }}\n"},
+		"template expandenv": {
+			"app/kustomization.yaml": "resources: []\n",
+			"app/subst.yaml":         "token: {{ expandenv \"$VAULT_TOKEN\" }}\n",
+		},
+		"subst resources": {
+			"app/kustomization.yaml": "resources: []\n",
+			"app/subst.yaml":         "resources:\n  - apiVersion: v1\n    kind: ConfigMap\n    metadata:\n      name: cm\n    data:\n      value: (( file \"/etc/passwd\" ))\n",
+		},
+	} {
+		resp := post(t, srv.URL+"/render", testArchive(t, files), map[string]string{"path": "app"})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, name)
+		body := read(t, resp)
+		assert.NotContains(t, body, "root:", name)
+		assert.NotContains(t, body, "process-token", name)
+	}
+}
+
+func TestAppSecret(t *testing.T) {
+	encrypted, err := os.ReadFile("../decryptors/ejson/testdata/encrypted.ejson")
+	assert.NoError(t, err)
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-a", Namespace: "subst-keys"},
+			Data:       map[string][]byte{"app.key": []byte("65b2f2060e6e3a976456c5a7cbcca3f15715eb1d9e0fe54174fa7b36aca1f50e")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-b", Namespace: "subst-keys"},
+			Data:       map[string][]byte{"app.key": []byte("8555475bf15814d4ccaa080cddbee899c78e0944e4c660f06d291396807cc579")},
+		},
+		// Same name as the application in a different namespace
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-b", Namespace: "team-b"},
+			Data:       map[string][]byte{"app.key": []byte("65b2f2060e6e3a976456c5a7cbcca3f15715eb1d9e0fe54174fa7b36aca1f50e")},
+		},
+	)
+	cfg := subst.DefaultConfiguration()
+	cfg.Secrets = []string{"team-b/team-b"}
+	srv := httptest.NewServer(New(Config{Configuration: cfg, Token: testToken, AppSecretNamespace: "subst-keys"}, subst.NewKeyCache(0), client).Handler())
+	defer srv.Close()
+
+	archive := testArchive(t, map[string]string{
+		"app/kustomization.yaml": "resources:\n  - secret.yaml\n",
+		"app/secret.yaml":        "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\nstringData:\n  user: (( grab subst.data.database_user ))\n",
+		"app/secrets.ejson":      string(encrypted),
+	})
+
+	resp := post(t, srv.URL+"/render", archive, map[string]string{"path": "app", "app": "team-a"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, read(t, resp), "user: MUCH_SECURE")
+
+	// Only the Secret of the application is read
+	resp = post(t, srv.URL+"/render", archive, map[string]string{"path": "app", "app": "team-b"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.NotContains(t, read(t, resp), "MUCH_SECURE")
+
+	for name, fields := range map[string]map[string]string{
+		"missing": {"path": "app"},
+		"invalid": {"path": "app", "app": "../team-a"},
+	} {
+		resp = post(t, srv.URL+"/render", archive, fields)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		resp.Body.Close()
+	}
+}
+
+func TestInvalidArchive(t *testing.T) {
+	srv := httptest.NewServer(New(Config{Configuration: subst.DefaultConfiguration(), MaxExtractedSize: 64, Token: testToken}, nil, nil).Handler())
+	defer srv.Close()
+
+	for name, files := range map[string]map[string]string{
+		"traversal": {"../kustomization.yaml": "resources: []\n"},
+		"absolute":  {"/etc/kustomization.yaml": "resources: []\n"},
+		"size":      {"kustomization.yaml": string(make([]byte, 65))},
+	} {
+		resp := post(t, srv.URL+"/render", testArchive(t, files), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		resp.Body.Close()
+	}
+
+	resp := post(t, srv.URL+"/render", testArchive(t, map[string]string{"kustomization.yaml": "resources: []\n"}), map[string]string{"path": "../.."})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestGenerator(t *testing.T) {
+	root := t.TempDir()
+	for _, cluster := range []string{"cluster-01", "cluster-02"} {
+		dir := filepath.Join(root, "clusters", cluster)
+		assert.NoError(t, os.MkdirAll(dir, 0700))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("resources: []\n"), 0600))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "subst.yaml"), []byte("cluster: "+cluster+"\nlocation:\n  region: (( grab subst.REGION ))\n"), 0600))
+	}
+	// Directories without kustomization are not generated
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "clusters", "docs"), 0700))
+
+	cfg := subst.DefaultConfiguration()
+	cfg.SkipDecrypt = true
+	srv := httptest.NewServer(New(Config{Configuration: cfg, GeneratorRoot: root, GeneratorToken: "token", Token: "render"}, nil, nil).Handler())
+	defer srv.Close()
+
+	generate := func(token string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+GeneratorPath, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	resp := generate("token", `{"applicationSetName": "clusters", "input": {"parameters": {"path": "clusters/*", "keys": ["cluster", "location.region"], "env": {"ARGOCD_ENV_REGION": "eu"}}}}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"output": {"parameters": [
+		{"path": "clusters/cluster-01", "path.basename": "cluster-01", "cluster": "cluster-01", "location.region": "eu"},
+		{"path": "clusters/cluster-02", "path.basename": "cluster-02", "cluster": "cluster-02", "location.region": "eu"}
+	]}}`, read(t, resp))
+
+	resp = generate("token", `{"input": {"parameters": {"path": "clusters/*", "keys": ["missing"], "env": {"ARGOCD_ENV_REGION": "eu"}}}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(t, read(t, resp), "$.subst.missing")
+
+	resp = generate("token", `{"input": {"parameters": {"path": "../*", "keys": ["cluster"]}}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	resp = generate("invalid", `{"input": {"parameters": {"path": "clusters/*", "keys": ["cluster"]}}}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	// The generator token replaces the token of the server
+	resp = generate("render", `{"input": {"parameters": {"path": "clusters/*", "keys": ["cluster"]}}}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+}
@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/geofffranks/simpleyaml"
 	"github.com/starkandwayne/goutils/ansi"
 	"gopkg.in/yaml.v2"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 // Convert converts a map[string]interface{} to a map[interface{}]interface{}.
@@ -20,6 +22,48 @@ func ToInterface(inputMap map[string]interface{}) map[interface{}]interface{} {
 	return convertedMap
 }
 
+// convert map[string]interface{} recursive to map[interface{}]interface{}
+func ToInterfaceDeep(inputMap map[string]interface{}) map[interface{}]interface{} {
+	convertedMap := make(map[interface{}]interface{}, len(inputMap))
+	for key, value := range inputMap {
+		convertedMap[key] = interfacify(value)
+	}
+	return convertedMap
+}
+
+func interfacify(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return ToInterfaceDeep(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = interfacify(item)
+		}
+		return out
+	}
+	return value
+}
+
+// DeepCopy copies maps and slices of a value (recursive)
+func DeepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			out[key] = DeepCopy(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = DeepCopy(item)
+		}
+		return out
+	}
+	return value
+}
+
 // convert map[interface{}]interface{} recursive to map[string]string
 func ToMap(i map[interface{}]interface{}) map[string]interface{} {
 	out := mapify(i)
@@ -51,11 +95,11 @@ func ConvertPath(path string) string {
 func ParseYAML(data []byte) (map[interface{}]interface{}, error) {
 	y, err := simpleyaml.NewYaml(data)
 	if err != nil {
-		return nil, err
+		return nil, lineError(err)
 	}
 
 	if empty_y, _ := simpleyaml.NewYaml([]byte{}); *y == *empty_y {
-		fmt.Println("YAML doc is empty, creating empty hash/map")
+		// Empty documents result in an empty map
 		return make(map[interface{}]interface{}), nil
 	}
 
@@ -72,13 +116,20 @@ func ParseYAML(data []byte) (map[interface{}]interface{}, error) {
 }
 
 // create a golang function which prints map[interface{}]interface{} as yaml
-func PrintYAML(data map[interface{}]interface{}) error {
-	y, err := yaml.Marshal(data)
+// the key order follows the given layout (may be nil)
+func PrintYAML(data map[interface{}]interface{}, layout *kyaml.Node) error {
+	return WriteYAML(os.Stdout, data, layout)
+}
+
+// writes map[interface{}]interface{} as yaml document to the writer
+// the key order follows the given layout (may be nil)
+func WriteYAML(w io.Writer, data map[interface{}]interface{}, layout *kyaml.Node) error {
+	y, err := MarshalYAML(data, layout)
 	if err != nil {
 		return err
 	}
 
-	writer := bufio.NewWriter(os.Stdout)
+	writer := bufio.NewWriter(w)
 	defer writer.Flush()
 
 	if _, err := writer.WriteString("---\n"); err != nil {
@@ -93,11 +144,16 @@ func PrintYAML(data map[interface{}]interface{}) error {
 
 // create a golang function which prints map[interface{}]interface{}
 func PrintJSON(data map[interface{}]interface{}) error {
+	return WriteJSON(os.Stdout, data)
+}
+
+// writes map[interface{}]interface{} as json to the writer
+func WriteJSON(w io.Writer, data map[interface{}]interface{}) error {
 	j, err := json.MarshalIndent(mapify(data), "", "  ")
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(j))
+	_, err = fmt.Fprintln(w, string(j))
 	return err
 }
 
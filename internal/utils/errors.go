@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+var (
+	// yaml: line 3: mapping values are not allowed in this context
+	yamlErrorRegex = regexp.MustCompile(`yaml: line (\d+): (.*)$`)
+	// template: f:3:12: executing "f" at <.missing>: ...
+	templateErrorRegex = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: (.*)$`)
+	// $.spec.replicas: Unable to resolve `subst.replicas`: ...
+	pathErrorRegex = regexp.MustCompile(`^(\$\S*): (.*)$`)
+	// color codes of spruce messages
+	ansiRegex = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// SourceError locates an error within a substitution file or manifest
+type SourceError struct {
+	// File the error was found in
+	File string `json:"file,omitempty"`
+	// Line and column within the file (1-based, 0 if unknown)
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+	// Resource identity (<kind> <namespace>/<name>)
+	Resource string `json:"resource,omitempty"`
+	// YAML path of the affected field (eg. $.spec.replicas)
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+func (e *SourceError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&b, ":%d", e.Line)
+			if e.Column > 0 {
+				fmt.Fprintf(&b, ":%d", e.Column)
+			}
+		}
+		b.WriteString(": ")
+	}
+	if e.Resource != "" {
+		b.WriteString(e.Resource + ": ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Locate sets the line and column of the error's YAML path within the given
+// document (if the path exists in the document)
+func (e *SourceError) Locate(data []byte) {
+	if e.Line > 0 || e.Path == "" {
+		return
+	}
+	var doc kyaml.Node
+	if err := kyaml.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if node := findPath(unwrapDocument(&doc), e.Path); node != nil {
+		e.Line, e.Column = node.Line, node.Column
+	}
+}
+
+// LocateResource sets the line and column of the error's YAML path within the
+// document of the given resource (the data may contain multiple documents).
+// Returns false if the data does not contain the resource.
+func (e *SourceError) LocateResource(data []byte, kind string, name string) bool {
+	decoder := kyaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc kyaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			return false
+		}
+		root := unwrapDocument(&doc)
+		if root == nil || root.Kind != kyaml.MappingNode {
+			continue
+		}
+		k, metadata := lookupKey(root, "kind"), lookupKey(root, "metadata")
+		if k == nil || k.Value != kind || metadata == nil {
+			continue
+		}
+		if n := lookupKey(metadata, "name"); n == nil || n.Value != name {
+			continue
+		}
+		if e.Line > 0 {
+			return true
+		}
+		// Fields added by kustomize (eg. patches) are located at the resource
+		node := findPath(root, e.Path)
+		if node == nil {
+			node = root
+		}
+		e.Line, e.Column = node.Line, node.Column
+		return true
+	}
+}
+
+// SourceErrors returns all located errors within the error tree
+func SourceErrors(err error) (errs []*SourceError) {
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *SourceError:
+			errs = append(errs, e)
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		default:
+			walk(errors.Unwrap(err))
+		}
+	}
+	walk(err)
+	return errs
+}
+
+// ErrorList flattens the error tree to a list of located errors, errors
+// without location are added with their message only
+func ErrorList(err error) (errs []*SourceError) {
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *SourceError:
+			errs = append(errs, e)
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		default:
+			if len(SourceErrors(err)) > 0 {
+				walk(errors.Unwrap(err))
+			} else {
+				errs = append(errs, &SourceError{Message: err.Error(), Err: err})
+			}
+		}
+	}
+	walk(err)
+	return errs
+}
+
+// WithSource applies fn to all located errors within the error tree. If the
+// tree has no located errors, the error is wrapped in a new one. Wrapping
+// messages (fmt.Errorf) are dropped, as they contain the located errors
+// without the applied changes.
+func WithSource(err error, fn func(e *SourceError)) error {
+	if err == nil {
+		return nil
+	}
+	errs := SourceErrors(err)
+	if len(errs) == 0 {
+		located := &SourceError{Message: err.Error(), Err: err}
+		fn(located)
+		return located
+	}
+	joined := make([]error, len(errs))
+	for i, e := range errs {
+		fn(e)
+		joined[i] = e
+	}
+	if len(joined) == 1 {
+		return joined[0]
+	}
+	return errors.Join(joined...)
+}
+
+// PathErrors converts errors of the format "<yaml path>: <message>" (as
+// returned by spruce) to located errors, multiple errors are joined
+func PathErrors(inner []error) error {
+	if len(inner) == 0 {
+		return nil
+	}
+	errs := make([]error, 0, len(inner))
+	for _, e := range inner {
+		msg := ansiRegex.ReplaceAllString(e.Error(), "")
+		if m := pathErrorRegex.FindStringSubmatch(msg); m != nil {
+			errs = append(errs, &SourceError{Path: m[1], Message: m[2], Err: e})
+		} else {
+			errs = append(errs, &SourceError{Message: msg, Err: e})
+		}
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	// The order of spruce errors is not stable
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// converts yaml and template errors, which contain the line number, to
+// located errors
+func lineError(err error) error {
+	msg := err.Error()
+	if m := yamlErrorRegex.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &SourceError{Line: line, Message: m[2], Err: err}
+	}
+	if m := templateErrorRegex.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		column, _ := strconv.Atoi(m[2])
+		return &SourceError{Line: line, Column: column, Message: m[3], Err: err}
+	}
+	return err
+}
+
+// finds the node of a spruce path (eg. $.spec.containers.nginx.image) within
+// the node. List entries are addressed by index or by name.
+func findPath(node *kyaml.Node, path string) *kyaml.Node {
+	for _, segment := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), ".") {
+		if node == nil || segment == "" {
+			break
+		}
+		switch node.Kind {
+		case kyaml.MappingNode:
+			node = lookupKey(node, segment)
+		case kyaml.SequenceNode:
+			node = sequenceEntry(node, segment)
+		default:
+			return nil
+		}
+	}
+	return node
+}
+
+func sequenceEntry(node *kyaml.Node, segment string) *kyaml.Node {
+	if i, err := strconv.Atoi(segment); err == nil {
+		if i >= 0 && i < len(node.Content) {
+			return node.Content[i]
+		}
+		return nil
+	}
+	for _, entry := range node.Content {
+		if name := lookupKey(entry, "name"); name != nil && name.Value == segment {
+			return entry
+		}
+	}
+	return nil
+}
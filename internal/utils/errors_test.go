@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const errorSource = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: nginx
+          image: (( grab subst.image ))
+`
+
+func TestPathErrors(t *testing.T) {
+	err := PathErrors([]error{
+		errors.New("$.spec.template.spec.containers.nginx.image: Unable to resolve `subst.image`"),
+		errors.New("cycle detected"),
+	})
+	errs := SourceErrors(err)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "$.spec.template.spec.containers.nginx.image", errs[0].Path)
+	assert.Equal(t, "", errs[1].Path)
+
+	errs[0].Locate([]byte(errorSource))
+	assert.Equal(t, 10, errs[0].Line)
+	assert.Equal(t, 18, errs[0].Column)
+
+	// The location is added to all errors, wrapping messages are dropped
+	err = WithSource(fmt.Errorf("failed to merge: %w", err), func(e *SourceError) {
+		e.File = "app.yaml"
+		e.Resource = "Deployment /app"
+	})
+	assert.EqualError(t, err, "app.yaml:10:18: Deployment /app: $.spec.template.spec.containers.nginx.image: Unable to resolve `subst.image`\n"+
+		"app.yaml: Deployment /app: cycle detected")
+}
+
+func TestLocateResource(t *testing.T) {
+	data := []byte("kind: ConfigMap\nmetadata:\n  name: other\n---\n" + errorSource)
+	e := &SourceError{Path: "$.spec.replicas"}
+	assert.False(t, e.LocateResource(data, "Deployment", "missing"))
+	// Fields which are not part of the source are located at the resource
+	assert.True(t, e.LocateResource(data, "Deployment", "app"))
+	assert.Equal(t, 5, e.Line)
+}
+
+func TestLineErrors(t *testing.T) {
+	_, err := ParseYAML([]byte("a: 1\nb: [\n"))
+	var located *SourceError
+	assert.True(t, errors.As(err, &located))
+	assert.Equal(t, 2, located.Line)
+
+	_, err = Template([]byte("a: 1\nb: {{ .x | missing }}\n"), nil, nil)
+	assert.True(t, errors.As(err, &located))
+	assert.Equal(t, 2, located.Line)
+	assert.Equal(t, `function "missing" not defined`, located.Message)
+
+	// Errors without location are kept
+	errs := ErrorList(errors.Join(errors.New("plain"), located))
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "plain", errs[0].Message)
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// ParseLayout parses YAML/JSON data into a node tree. The node tree is only
+// used as layout reference, it retains the key order, comments and scalar
+// styles of the source document.
+func ParseLayout(data []byte) (*kyaml.Node, error) {
+	r, err := kyaml.Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return r.YNode(), nil
+}
+
+// MergeLayout adds all mapping keys from src, which are not yet present
+// in dst, to dst (recursive). Returns the resulting layout.
+func MergeLayout(dst *kyaml.Node, src *kyaml.Node) *kyaml.Node {
+	src = unwrapDocument(src)
+	if src == nil {
+		return dst
+	}
+	dst = unwrapDocument(dst)
+	if dst == nil || dst.Kind != src.Kind || dst.Kind != kyaml.MappingNode {
+		if dst == nil {
+			return src
+		}
+		return dst
+	}
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		if existing := lookupKey(dst, key.Value); existing != nil {
+			MergeLayout(existing, value)
+			continue
+		}
+		dst.Content = append(dst.Content, key, value)
+	}
+	return dst
+}
+
+// MarshalYAML marshals the data as YAML. Mapping keys are ordered the same way
+// as in the layout, keys which are not part of the layout are appended in sorted
+// order. Comments and scalar styles of unchanged values are taken over
+// from the layout. The layout may be nil, which results in sorted keys.
+func MarshalYAML(data map[interface{}]interface{}, layout *kyaml.Node) ([]byte, error) {
+	node, err := toNode(data, unwrapDocument(layout))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := kyaml.NewEncoder(&buf)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// converts go value to node (recursive) based on the layout
+func toNode(value interface{}, layout *kyaml.Node) (*kyaml.Node, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		return mapNode(v, layout)
+	case map[string]interface{}:
+		return mapNode(ToInterface(v), layout)
+	case []interface{}:
+		node := &kyaml.Node{Kind: kyaml.SequenceNode, Tag: "!!seq"}
+		for i, item := range v {
+			var itemLayout *kyaml.Node
+			if layout != nil && layout.Kind == kyaml.SequenceNode && i < len(layout.Content) {
+				itemLayout = layout.Content[i]
+			}
+			n, err := toNode(item, itemLayout)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, n)
+		}
+		copyDecoration(node, layout)
+		return node, nil
+	default:
+		node := &kyaml.Node{}
+		if err := node.Encode(v); err != nil {
+			return nil, err
+		}
+		if layout != nil && layout.Kind == kyaml.ScalarNode && layout.Tag == node.Tag && layout.Value == node.Value {
+			node.Style = layout.Style
+		}
+		copyDecoration(node, layout)
+		return node, nil
+	}
+}
+
+func mapNode(m map[interface{}]interface{}, layout *kyaml.Node) (*kyaml.Node, error) {
+	node := &kyaml.Node{Kind: kyaml.MappingNode, Tag: "!!map"}
+	if layout != nil && layout.Kind != kyaml.MappingNode {
+		layout = nil
+	}
+
+	keys := make([]string, 0, len(m))
+	index := make(map[string]interface{}, len(m))
+	for k := range m {
+		key := fmt.Sprintf("%v", k)
+		keys = append(keys, key)
+		index[key] = k
+	}
+	sort.Strings(keys)
+
+	// Keys present in the layout keep their position
+	ordered := make([]string, 0, len(keys))
+	positions := make(map[string]int, len(keys))
+	if layout != nil {
+		for i := 0; i+1 < len(layout.Content); i += 2 {
+			key := layout.Content[i].Value
+			if _, seen := positions[key]; seen {
+				continue
+			}
+			positions[key] = i
+			if _, ok := index[key]; ok {
+				ordered = append(ordered, key)
+			}
+		}
+	}
+	seen := make(map[string]bool, len(ordered))
+	for _, key := range ordered {
+		seen[key] = true
+	}
+	for _, key := range keys {
+		if !seen[key] {
+			ordered = append(ordered, key)
+		}
+	}
+
+	for _, key := range ordered {
+		var keyLayout, valueLayout *kyaml.Node
+		if i, ok := positions[key]; ok {
+			keyLayout, valueLayout = layout.Content[i], layout.Content[i+1]
+		}
+
+		k, err := toNode(index[key], keyLayout)
+		if err != nil {
+			return nil, err
+		}
+		v, err := toNode(m[index[key]], valueLayout)
+		if err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, k, v)
+	}
+	copyDecoration(node, layout)
+	return node, nil
+}
+
+// takes over comments from the layout node
+func copyDecoration(node *kyaml.Node, layout *kyaml.Node) {
+	if layout == nil || layout.Kind != node.Kind {
+		return
+	}
+	node.HeadComment = layout.HeadComment
+	node.LineComment = layout.LineComment
+	node.FootComment = layout.FootComment
+	if node.Kind != kyaml.ScalarNode && layout.Style == kyaml.FlowStyle {
+		node.Style = layout.Style
+	}
+}
+
+func lookupKey(node *kyaml.Node, key string) *kyaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func unwrapDocument(node *kyaml.Node) *kyaml.Node {
+	if node != nil && node.Kind == kyaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return node.Content[0]
+	}
+	return node
+}
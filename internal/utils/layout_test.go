@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const layoutSource = `kind: ConfigMap
+apiVersion: v1
+metadata:
+  # resource name
+  name: test
+data:
+  zone: "west"
+  port: "8080"
+`
+
+func TestMarshalYAMLKeepsLayout(t *testing.T) {
+	layout, err := ParseLayout([]byte(layoutSource))
+	assert.NoError(t, err)
+
+	data, err := ParseYAML([]byte(layoutSource))
+	assert.NoError(t, err)
+	data["data"].(map[interface{}]interface{})["added"] = "value"
+
+	out, err := MarshalYAML(data, layout)
+	assert.NoError(t, err)
+	assert.Equal(t, `kind: ConfigMap
+apiVersion: v1
+metadata:
+  # resource name
+  name: test
+data:
+  zone: "west"
+  port: "8080"
+  added: value
+`, string(out))
+
+	// Output must be byte-stable
+	for i := 0; i < 10; i++ {
+		again, err := MarshalYAML(data, layout)
+		assert.NoError(t, err)
+		assert.Equal(t, string(out), string(again))
+	}
+}
+
+func TestMarshalYAMLWithoutLayout(t *testing.T) {
+	out, err := MarshalYAML(map[interface{}]interface{}{"b": 1, "a": []interface{}{"x", true}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a:\n- x\n- true\nb: 1\n", string(out))
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Key of the placeholders without a derived key (see RedactKey), random for
+// each process. Placeholders can be compared within a process (eg. a diff),
+// but guesses of short values (eg. PINs) can not be confirmed offline from
+// logs.
+var processKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("failed to generate redaction key: " + err.Error())
+	}
+	return key
+}()
+
+// RedactKey derives the key of placeholders from stable secret input (eg. a
+// configured salt or a fingerprint of the decryption keys), placeholders are
+// then comparable across runs with the same input
+func RedactKey(input []byte) []byte {
+	key := sha256.Sum256(append([]byte("subst-redact\x00"), input...))
+	return key[:]
+}
+
+// Redact returns the placeholder of a secret value with the key of the
+// process. The placeholder contains a short keyed hash (HMAC-SHA256), so
+// values can be compared without revealing them.
+func Redact(value string) string {
+	return RedactWithKey(processKey, value)
+}
+
+// RedactWithKey returns the placeholder of a secret value with the given key
+// (see RedactKey), the key of the process is used if nil
+func RedactWithKey(key []byte, value string) string {
+	if key == nil {
+		key = processKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "<redacted hmac:" + hex.EncodeToString(mac.Sum(nil)[:4]) + ">"
+}
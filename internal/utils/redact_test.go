@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, Redact("1234"), Redact("1234"))
+	assert.NotEqual(t, Redact("1234"), Redact("1235"))
+	assert.NotContains(t, Redact("1234"), "1234")
+
+	// The placeholder can not be computed without the key of the process
+	sum := sha256.Sum256([]byte("1234"))
+	assert.NotEqual(t, "<redacted hmac:"+hex.EncodeToString(sum[:4])+">", Redact("1234"))
+
+	// Derived keys are stable
+	key := RedactKey([]byte("salt"))
+	assert.Equal(t, "<redacted hmac:b1b40aa1>", RedactWithKey(key, "1234"))
+	assert.NotEqual(t, RedactWithKey(key, "1234"), RedactWithKey(RedactKey([]byte("other")), "1234"))
+	assert.Equal(t, Redact("1234"), RedactWithKey(nil, "1234"))
+}
@@ -5,6 +5,7 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"os"
 	"strings"
 	"text/template"
 
@@ -13,15 +14,20 @@ import (
 	"sigs.k8s.io/yaml"
 )
 
-func Template(data []byte, values map[interface{}]interface{}) (map[interface{}]interface{}, error) {
-	tmpl, err := template.New("f").Funcs(SprigFuncMap()).Parse(string(data))
+// Template executes data as template with the given values and functions
+// (SprigFuncMap if nil) and parses the result
+func Template(data []byte, values map[interface{}]interface{}, funcs template.FuncMap) (map[interface{}]interface{}, error) {
+	if funcs == nil {
+		funcs = SprigFuncMap()
+	}
+	tmpl, err := template.New("f").Funcs(funcs).Parse(string(data))
 	if err != nil {
-		return nil, err
+		return nil, lineError(err)
 	}
 
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, ToMap(values)); err != nil {
-		return nil, err
+		return nil, lineError(err)
 	}
 
 	return ParseYAML(buf.Bytes())
@@ -61,6 +67,20 @@ func SprigFuncMap() template.FuncMap {
 	return f
 }
 
+// BindEnvFuncs replaces the environment functions of sprig ("env" and
+// "expandenv"), which read the process environment, with functions reading
+// the given variables
+func BindEnvFuncs(f template.FuncMap, env map[string]string) {
+	f["env"] = func(key string) string {
+		return env[key]
+	}
+	f["expandenv"] = func(s string) string {
+		return os.Expand(s, func(key string) string {
+			return env[key]
+		})
+	}
+}
+
 // toYAML takes an interface, marshals it to yaml, and returns a string. It will
 // always return a string, even on marshal error (empty string).
 //
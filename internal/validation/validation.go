@@ -0,0 +1,336 @@
+// Package validation validates manifests against the OpenAPI schemas of their
+// kind. The Kubernetes schemas are bundled (no access to a cluster is
+// required), schemas of custom resources are read from their
+// CustomResourceDefinitions.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bedag/subst/internal/utils"
+	openapi_v2 "github.com/google/gnostic-models/openapiv2"
+	"google.golang.org/protobuf/proto"
+	valerrors "k8s.io/kube-openapi/pkg/validation/errors"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/openapi/kubernetesapi"
+)
+
+const gvkExtension = "x-kubernetes-group-version-kind"
+
+// definitions, which accept integers and strings
+var intOrString = map[string]bool{
+	"io.k8s.apimachinery.pkg.util.intstr.IntOrString": true,
+	"io.k8s.apimachinery.pkg.api.resource.Quantity":   true,
+}
+
+// matches list indexes of the validation errors (eg. list[0].name)
+var indexRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// Type identifies the schema of a manifest
+type Type struct {
+	APIVersion string
+	Kind       string
+}
+
+// bundled Kubernetes schemas, parsed once and only read afterwards
+var builtin struct {
+	once        sync.Once
+	err         error
+	definitions spec.Definitions
+	types       map[Type]string
+}
+
+func loadBuiltin() error {
+	builtin.once.Do(func() {
+		version := kubernetesapi.DefaultOpenAPI
+		asset := "kubernetesapi/" + strings.ReplaceAll(version, ".", "_") + "/swagger.pb"
+		doc := &openapi_v2.Document{}
+		if err := proto.Unmarshal(kubernetesapi.OpenAPIMustAsset[version](asset), doc); err != nil {
+			builtin.err = fmt.Errorf("failed to parse bundled Kubernetes schema: %w", err)
+			return
+		}
+		var swagger spec.Swagger
+		if _, err := swagger.FromGnostic(doc); err != nil {
+			builtin.err = fmt.Errorf("failed to parse bundled Kubernetes schema: %w", err)
+			return
+		}
+		builtin.definitions = swagger.Definitions
+		builtin.types = make(map[Type]string)
+		for name, definition := range swagger.Definitions {
+			gvks, ok := definition.Extensions[gvkExtension].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, gvk := range gvks {
+				m, ok := gvk.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				group, _ := m["group"].(string)
+				version, _ := m["version"].(string)
+				kind, _ := m["kind"].(string)
+				builtin.types[Type{APIVersion: apiVersion(group, version), Kind: kind}] = name
+			}
+		}
+	})
+	return builtin.err
+}
+
+func apiVersion(group string, version string) string {
+	if group == "" {
+		return version
+	}
+	return group + "/" + version
+}
+
+// Validator validates manifests against the bundled Kubernetes schemas and
+// the added CustomResourceDefinitions. A validator must not be used
+// concurrently.
+type Validator struct {
+	crds     map[Type]*spec.Schema
+	expanded map[Type]*spec.Schema
+}
+
+// New creates a validator with the bundled Kubernetes schemas
+func New() (*Validator, error) {
+	if err := loadBuiltin(); err != nil {
+		return nil, err
+	}
+	return &Validator{
+		crds:     make(map[Type]*spec.Schema),
+		expanded: make(map[Type]*spec.Schema),
+	}, nil
+}
+
+// AddCRD adds the schemas of the versions of a CustomResourceDefinition
+// (apiextensions.k8s.io/v1 or v1beta1), other manifests are ignored
+func (v *Validator) AddCRD(manifest map[string]interface{}) error {
+	if manifest["kind"] != "CustomResourceDefinition" {
+		return nil
+	}
+	spec_, _ := manifest["spec"].(map[string]interface{})
+	group, _ := spec_["group"].(string)
+	names, _ := spec_["names"].(map[string]interface{})
+	kind, _ := names["kind"].(string)
+	if group == "" || kind == "" {
+		return fmt.Errorf("invalid CustomResourceDefinition: spec.group and spec.names.kind are required")
+	}
+
+	// v1beta1 schemas may be defined for all versions
+	var common interface{}
+	if validation, ok := spec_["validation"].(map[string]interface{}); ok {
+		common = validation["openAPIV3Schema"]
+	}
+
+	versions, _ := spec_["versions"].([]interface{})
+	if len(versions) == 0 {
+		if version, ok := spec_["version"].(string); ok {
+			versions = append(versions, map[string]interface{}{"name": version})
+		}
+	}
+	for _, item := range versions {
+		version, _ := item.(map[string]interface{})
+		name, _ := version["name"].(string)
+		raw := common
+		if schema, ok := version["schema"].(map[string]interface{}); ok {
+			raw = schema["openAPIV3Schema"]
+		}
+		if name == "" || raw == nil {
+			continue
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return fmt.Errorf("invalid schema of %s %s: %w", kind, name, err)
+		}
+		schema := &spec.Schema{}
+		if err := schema.UnmarshalJSON(data); err != nil {
+			return fmt.Errorf("invalid schema of %s %s: %w", kind, name, err)
+		}
+		t := Type{APIVersion: apiVersion(group, name), Kind: kind}
+		v.crds[t] = schema
+		delete(v.expanded, t)
+	}
+	return nil
+}
+
+// ErrNoSchema is returned for manifests of types without schema (eg. custom
+// resources without CustomResourceDefinition or a typo in the apiVersion)
+var ErrNoSchema = errors.New("no schema")
+
+// Validate validates the manifest against the schema of its kind, the
+// returned errors contain the path of the field. Manifests of unknown types
+// are not validated, ErrNoSchema is returned for them.
+func (v *Validator) Validate(manifest map[string]interface{}) error {
+	t := Type{}
+	t.APIVersion, _ = manifest["apiVersion"].(string)
+	t.Kind, _ = manifest["kind"].(string)
+	schema := v.schema(t)
+	if schema == nil {
+		return fmt.Errorf("%w for %s %s", ErrNoSchema, t.APIVersion, t.Kind)
+	}
+
+	result := validate.NewSchemaValidator(schema, nil, "", strfmt.Default).Validate(manifest)
+	errs := make([]error, 0, len(result.Errors))
+	for _, err := range result.Errors {
+		errs = append(errs, SourceError(err))
+	}
+	return errors.Join(errs...)
+}
+
+// returns the schema of the type with all references expanded
+func (v *Validator) schema(t Type) *spec.Schema {
+	if schema, ok := v.expanded[t]; ok {
+		return schema
+	}
+	var schema *spec.Schema
+	if crd, ok := v.crds[t]; ok {
+		e := &expander{definitions: crd.Definitions, resolving: map[string]bool{}, nullable: true}
+		schema = e.expand(crd)
+	} else if name, ok := builtin.types[t]; ok {
+		e := &expander{definitions: builtin.definitions, resolving: map[string]bool{}, nullable: true}
+		schema = e.expand(&spec.Schema{SchemaProps: spec.SchemaProps{Ref: spec.MustCreateRef("#/definitions/" + name)}})
+	}
+	v.expanded[t] = schema
+	return schema
+}
+
+// Expand returns a copy of the schema with the references resolved within
+// its definitions, the validator does not support references
+func Expand(s *spec.Schema) *spec.Schema {
+	e := &expander{definitions: s.Definitions, resolving: map[string]bool{}}
+	return e.expand(s)
+}
+
+// copies schemas with the references resolved within the definitions.
+// Recursive definitions (eg. JSONSchemaProps) accept any value below the
+// recursion.
+type expander struct {
+	definitions spec.Definitions
+	resolving   map[string]bool
+	// Kubernetes treats null values as unset
+	nullable bool
+}
+
+func (e *expander) expand(s *spec.Schema) *spec.Schema {
+	if s == nil {
+		return nil
+	}
+	if ref := s.Ref.String(); ref != "" {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		definition, ok := e.definitions[name]
+		if !ok || e.resolving[name] || intOrString[name] {
+			return &spec.Schema{}
+		}
+		e.resolving[name] = true
+		defer delete(e.resolving, name)
+		return e.expand(&definition)
+	}
+
+	c := *s
+	c.Definitions = nil
+	c.Nullable = c.Nullable || e.nullable
+	if c.Format == "int-or-string" || c.Extensions["x-kubernetes-int-or-string"] == true {
+		c.Type, c.Format = nil, ""
+	}
+	if s.Properties != nil {
+		c.Properties = make(map[string]spec.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			c.Properties[name] = *e.expand(&property)
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		c.AdditionalProperties = &spec.SchemaOrBool{
+			Allows: s.AdditionalProperties.Allows,
+			Schema: e.expand(s.AdditionalProperties.Schema),
+		}
+	}
+	if s.Items != nil {
+		items := &spec.SchemaOrArray{Schema: e.expand(s.Items.Schema)}
+		for _, item := range s.Items.Schemas {
+			items.Schemas = append(items.Schemas, *e.expand(&item))
+		}
+		c.Items = items
+	}
+	c.AllOf = e.expandAll(s.AllOf)
+	c.AnyOf = e.expandAll(s.AnyOf)
+	c.OneOf = e.expandAll(s.OneOf)
+	c.Not = e.expand(s.Not)
+	return &c
+}
+
+func (e *expander) expandAll(schemas []spec.Schema) []spec.Schema {
+	if schemas == nil {
+		return nil
+	}
+	out := make([]spec.Schema, len(schemas))
+	for i := range schemas {
+		out[i] = *e.expand(&schemas[i])
+	}
+	return out
+}
+
+// SourceError converts a validation error to a located error, the name of the
+// validation error is converted to a path (eg. list[0].name to $.list.0.name)
+func SourceError(err error) *utils.SourceError {
+	var v *valerrors.Validation
+	if !errors.As(err, &v) {
+		return &utils.SourceError{Message: err.Error(), Err: err}
+	}
+	name := strings.TrimPrefix(v.Name, ".")
+	message := strings.TrimPrefix(v.Error(), v.Name+" in "+v.In+" ")
+	path := "$"
+	if name != "" {
+		path += "." + indexRegex.ReplaceAllString(name, ".$1")
+	}
+	return &utils.SourceError{Path: path, Message: message, Err: err}
+}
+
+// AddCRDDir adds the CustomResourceDefinitions of the YAML and JSON files
+// within the directory (recursive), other manifests are ignored
+func (v *Validator) AddCRDDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		nodes, err := kio.FromBytes(data)
+		if err != nil {
+			return &utils.SourceError{File: path, Message: err.Error(), Err: err}
+		}
+		for _, node := range nodes {
+			if node.GetKind() != "CustomResourceDefinition" {
+				continue
+			}
+			manifest, err := node.Map()
+			if err != nil {
+				return &utils.SourceError{File: path, Message: err.Error(), Err: err}
+			}
+			if err := v.AddCRD(manifest); err != nil {
+				return &utils.SourceError{File: path, Resource: "CustomResourceDefinition " + node.GetName(), Message: err.Error(), Err: err}
+			}
+		}
+		return nil
+	})
+}
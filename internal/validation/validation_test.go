@@ -0,0 +1,176 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	valerrors "k8s.io/kube-openapi/pkg/validation/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const testCRD = `apiVersion: apiextensions.k8s.io/%[2]s
+kind: CustomResourceDefinition
+metadata:
+  name: buckets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Bucket
+    plural: buckets
+  scope: Namespaced
+  %[1]s
+`
+
+const v1Schema = `versions:
+    - name: v1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [size]
+              properties:
+                size:
+                  type: integer
+                port:
+                  x-kubernetes-int-or-string: true`
+
+const v1beta1Schema = `version: v1
+  validation:
+    openAPIV3Schema:
+      type: object
+      properties:
+        spec:
+          type: object
+          properties:
+            size:
+              type: integer`
+
+func parse(t *testing.T, manifest string) map[string]interface{} {
+	var m map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal([]byte(manifest), &m))
+	return m
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		crd      string
+		manifest string
+		paths    []string
+		noSchema bool
+	}{
+		{
+			name:     "deployment",
+			manifest: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\nspec:\n  selector: {}\n  template:\n    spec:\n      containers:\n        - name: app\n          ports:\n            - containerPort: 80\n",
+		},
+		{
+			name:     "type mismatch",
+			manifest: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\nspec:\n  selector: {}\n  template:\n    spec:\n      containers:\n        - name: app\n          ports:\n            - containerPort: \"80\"\n",
+			paths:    []string{"$.spec.template.spec.containers.0.ports.0.containerPort"},
+		},
+		{
+			name:     "null values",
+			manifest: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n  annotations:\ndata:\n",
+		},
+		{
+			name:     "int or string",
+			manifest: "apiVersion: v1\nkind: Service\nmetadata:\n  name: svc\nspec:\n  ports:\n    - port: 80\n      targetPort: http\n",
+		},
+		{
+			name:     "crd",
+			crd:      fmt.Sprintf(testCRD, v1Schema, "v1"),
+			manifest: "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  size: 3\n  port: http\n",
+		},
+		{
+			name:     "crd type mismatch",
+			crd:      fmt.Sprintf(testCRD, v1Schema, "v1"),
+			manifest: "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  size: large\n",
+			paths:    []string{"$.spec.size"},
+		},
+		{
+			name:     "crd required",
+			crd:      fmt.Sprintf(testCRD, v1Schema, "v1"),
+			manifest: "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  port: 80\n",
+			paths:    []string{"$.spec.size"},
+		},
+		{
+			name:     "v1beta1 crd",
+			crd:      fmt.Sprintf(testCRD, v1beta1Schema, "v1beta1"),
+			manifest: "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  size: large\n",
+			paths:    []string{"$.spec.size"},
+		},
+		{
+			name:     "unknown version",
+			crd:      fmt.Sprintf(testCRD, v1Schema, "v1"),
+			manifest: "apiVersion: example.com/v2\nkind: Bucket\nmetadata:\n  name: bucket\n",
+			noSchema: true,
+		},
+		{
+			name:     "no schema",
+			manifest: "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\n",
+			noSchema: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := New()
+			assert.NoError(t, err)
+			if tt.crd != "" {
+				assert.NoError(t, v.AddCRD(parse(t, tt.crd)))
+			}
+			err = v.Validate(parse(t, tt.manifest))
+			if tt.noSchema {
+				assert.ErrorIs(t, err, ErrNoSchema)
+				return
+			}
+			if len(tt.paths) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var paths []string
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				paths = append(paths, SourceError(e).Path)
+			}
+			assert.Equal(t, tt.paths, paths)
+		})
+	}
+}
+
+func TestAddCRD(t *testing.T) {
+	v, err := New()
+	assert.NoError(t, err)
+	// Other manifests are ignored
+	assert.NoError(t, v.AddCRD(parse(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n")))
+	assert.Error(t, v.AddCRD(parse(t, "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: invalid\nspec: {}\n")))
+}
+
+func TestAddCRDDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "nested"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "nested", "crd.yaml"), []byte(fmt.Sprintf(testCRD, v1Schema, "v1")), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("# CRDs\n"), 0600))
+
+	v, err := New()
+	assert.NoError(t, err)
+	assert.NoError(t, v.AddCRDDir(dir))
+	assert.Error(t, v.Validate(parse(t, "apiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  size: large\n")))
+}
+
+func TestSourceError(t *testing.T) {
+	err := SourceError(valerrors.InvalidType(".list[0].ports[12].name", "body", "string", 1))
+	assert.Equal(t, "$.list.0.ports.12.name", err.Path)
+	assert.Equal(t, "must be of type string", err.Message)
+
+	// Other errors are not located
+	err = SourceError(errors.New("failed"))
+	assert.Equal(t, "", err.Path)
+	assert.Equal(t, "failed", err.Message)
+}
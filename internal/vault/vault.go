@@ -0,0 +1,256 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	AuthToken      = "token"
+	AuthAppRole    = "approle"
+	AuthKubernetes = "kubernetes"
+
+	// DefaultServiceAccountTokenPath is the token used for kubernetes authentication
+	DefaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+type Config struct {
+	// Address of the Vault/OpenBao server (eg. https://vault:8200)
+	Address string
+	// Namespace (enterprise feature)
+	Namespace string
+	// Auth method: token, approle or kubernetes
+	Auth string
+	// Mount path of the auth method (defaults to the auth method name)
+	AuthMount string
+	// Token for token authentication
+	Token string
+	// Role and secret id for approle authentication
+	RoleID   string
+	SecretID string
+	// Role for kubernetes authentication
+	Role string
+	// Service account token for kubernetes authentication
+	ServiceAccountTokenPath string
+	// HTTP client used for requests (optional)
+	HTTPClient *http.Client
+}
+
+// Client resolves references against the Vault API. Resolved
+// values are cached for the lifetime of the client.
+type Client struct {
+	cfg   Config
+	mu    sync.Mutex
+	token string
+	cache map[string]interface{}
+}
+
+// New creates a client, authentication happens with the first request
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("vault address is required")
+	}
+	if cfg.Auth == "" {
+		cfg.Auth = AuthToken
+	}
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = cfg.Auth
+	}
+	if cfg.ServiceAccountTokenPath == "" {
+		cfg.ServiceAccountTokenPath = DefaultServiceAccountTokenPath
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	switch cfg.Auth {
+	case AuthToken:
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("vault token authentication requires a token")
+		}
+	case AuthAppRole:
+		if cfg.RoleID == "" || cfg.SecretID == "" {
+			return nil, fmt.Errorf("vault approle authentication requires a role id and secret id")
+		}
+	case AuthKubernetes:
+		if cfg.Role == "" {
+			return nil, fmt.Errorf("vault kubernetes authentication requires a role")
+		}
+	default:
+		return nil, fmt.Errorf("unknown vault auth method %q (supported: token, approle, kubernetes)", cfg.Auth)
+	}
+
+	return &Client{
+		cfg:   cfg,
+		token: cfg.Token,
+		cache: make(map[string]interface{}),
+	}, nil
+}
+
+// Resolve reads the value of the given reference. References have the format:
+//
+//	<path>[:<key>]                       read a KV secret (v1 or v2), optionally a single key
+//	<mount>/decrypt/<name>:<ciphertext>  decrypt a ciphertext with the transit engine
+func (c *Client) Resolve(ctx context.Context, ref string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.cache[ref]; ok {
+		return v, nil
+	}
+
+	path, key, _ := strings.Cut(strings.TrimPrefix(ref, "/"), ":")
+	if path == "" {
+		return nil, fmt.Errorf("invalid vault reference %q", ref)
+	}
+
+	var value interface{}
+	var err error
+	if strings.Contains(path, "/decrypt/") {
+		value, err = c.transitDecrypt(ctx, path, key)
+	} else {
+		value, err = c.read(ctx, path, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve vault reference %q: %w", ref, err)
+	}
+
+	c.cache[ref] = value
+	return value, nil
+}
+
+// reads a KV secret (the secret data is cached per path)
+func (c *Client) read(ctx context.Context, path string, key string) (interface{}, error) {
+	data, ok := c.cache[path].(map[string]interface{})
+	if !ok {
+		resp, err := c.request(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, _ = resp["data"].(map[string]interface{})
+		// KV v2 wraps the secret data with metadata
+		if inner, isV2 := data["data"].(map[string]interface{}); isV2 && data["metadata"] != nil {
+			data = inner
+		}
+		if data == nil {
+			return nil, fmt.Errorf("no data found at %s", path)
+		}
+		c.cache[path] = data
+	}
+
+	if key == "" {
+		return data, nil
+	}
+	value, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found at %s", key, path)
+	}
+	return value, nil
+}
+
+func (c *Client) transitDecrypt(ctx context.Context, path string, ciphertext string) (interface{}, error) {
+	if ciphertext == "" {
+		return nil, fmt.Errorf("transit decryption requires a ciphertext")
+	}
+	resp, err := c.request(ctx, http.MethodPost, path, map[string]interface{}{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	data, _ := resp["data"].(map[string]interface{})
+	plaintext, ok := data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("no plaintext returned from %s", path)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return string(decoded), nil
+}
+
+// authenticates with the configured auth method
+func (c *Client) login(ctx context.Context) error {
+	var body map[string]interface{}
+	switch c.cfg.Auth {
+	case AuthAppRole:
+		body = map[string]interface{}{"role_id": c.cfg.RoleID, "secret_id": c.cfg.SecretID}
+	case AuthKubernetes:
+		jwt, err := os.ReadFile(c.cfg.ServiceAccountTokenPath)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %w", err)
+		}
+		body = map[string]interface{}{"role": c.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return nil
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "auth/"+c.cfg.AuthMount+"/login", body, "")
+	if err != nil {
+		return fmt.Errorf("vault %s login failed: %w", c.cfg.Auth, err)
+	}
+	auth, _ := resp["auth"].(map[string]interface{})
+	token, _ := auth["client_token"].(string)
+	if token == "" {
+		return fmt.Errorf("vault %s login returned no token", c.cfg.Auth)
+	}
+	c.token = token
+	return nil
+}
+
+func (c *Client) request(ctx context.Context, method string, path string, body map[string]interface{}) (map[string]interface{}, error) {
+	if c.token == "" {
+		if err := c.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c.do(ctx, method, path, body, c.token)
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, body map[string]interface{}, token string) (map[string]interface{}, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	url := strings.TrimSuffix(c.cfg.Address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s %v", method, path, resp.Status, out["errors"])
+	}
+	return out, nil
+}
@@ -0,0 +1,127 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand-in for the Vault API, counts the requests per path
+func testServer(t *testing.T, requests map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "approle-token"}})
+			return
+		case "/v1/auth/kubernetes/login":
+			if body["role"] != "subst" || body["jwt"] != "sa-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "k8s-token"}})
+			return
+		}
+
+		if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "approle-token" && token != "k8s-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"password": "s3cr3t", "user": "admin"},
+				"metadata": map[string]interface{}{"version": 1},
+			}})
+		case "/v1/kv/app":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"password": "v1"}})
+		case "/v1/transit/decrypt/app":
+			assert.Equal(t, "vault:v1:abc", body["ciphertext"])
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"plaintext": base64.StdEncoding.EncodeToString([]byte("transit-secret")),
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+		}
+	}))
+}
+
+func TestResolveWithToken(t *testing.T) {
+	requests := map[string]int{}
+	server := testServer(t, requests)
+	defer server.Close()
+
+	client, err := New(Config{Address: server.URL, Token: "root"})
+	assert.NoError(t, err)
+
+	value, err := client.Resolve(context.Background(), "secret/data/app:password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", value)
+
+	value, err = client.Resolve(context.Background(), "secret/data/app:user")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", value)
+	assert.Equal(t, 1, requests["/v1/secret/data/app"], "Expected the secret to be cached")
+
+	value, err = client.Resolve(context.Background(), "secret/data/app")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"password": "s3cr3t", "user": "admin"}, value)
+
+	value, err = client.Resolve(context.Background(), "kv/app:password")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", value)
+
+	value, err = client.Resolve(context.Background(), "transit/decrypt/app:vault:v1:abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "transit-secret", value)
+
+	_, err = client.Resolve(context.Background(), "secret/data/app:missing")
+	assert.Error(t, err)
+	_, err = client.Resolve(context.Background(), "secret/data/unknown:key")
+	assert.Error(t, err)
+}
+
+func TestResolveWithLogin(t *testing.T) {
+	requests := map[string]int{}
+	server := testServer(t, requests)
+	defer server.Close()
+
+	client, err := New(Config{Address: server.URL, Auth: AuthAppRole, RoleID: "role", SecretID: "secret"})
+	assert.NoError(t, err)
+	value, err := client.Resolve(context.Background(), "secret/data/app:password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", value)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenPath, []byte("sa-token\n"), 0600))
+	client, err = New(Config{Address: server.URL, Auth: AuthKubernetes, Role: "subst", ServiceAccountTokenPath: tokenPath})
+	assert.NoError(t, err)
+	value, err = client.Resolve(context.Background(), "secret/data/app:user")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", value)
+
+	client, err = New(Config{Address: server.URL, Auth: AuthAppRole, RoleID: "role", SecretID: "wrong"})
+	assert.NoError(t, err)
+	_, err = client.Resolve(context.Background(), "secret/data/app:password")
+	assert.Error(t, err)
+
+	_, err = New(Config{Address: server.URL, Auth: "ldap"})
+	assert.Error(t, err)
+}
@@ -1,13 +1,49 @@
 package wrapper
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/bedag/spruce"
+	"github.com/bedag/subst/internal/utils"
 )
 
+// Spruce keeps state of the evaluation in package variables (eg. paths to
+// prune or sort), merges and evaluations must therefore not run concurrently.
+// Only evaluations without stateful operators (see SpruceEvalOperators) run
+// without the lock.
+var spruceMu sync.Mutex
+
+// Operators keeping state in package variables of spruce (paths to prune or
+// sort, Vault and AWS clients and caches, used IPs), all other operators only
+// read and modify the tree of their evaluator
+var statefulOperators = map[string]bool{
+	"prune":      true,
+	"sort":       true,
+	"vault":      true,
+	"awsparam":   true,
+	"awssecret":  true,
+	"static_ips": true,
+}
+
+// Run Spruce Merge
+func SpruceMerge(l ...map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	spruceMu.Lock()
+	defer spruceMu.Unlock()
+	merge, err := spruce.Merge(l...)
+	return merge, spruceError(err)
+}
+
 // Run Spruce Eval and return evaluator
 func SpruceEval(data map[interface{}]interface{}, prune []string) (eval *spruce.Evaluator, err error) {
+	spruceMu.Lock()
+	defer spruceMu.Unlock()
+	return spruceEval(data, prune)
+}
+
+func spruceEval(data map[interface{}]interface{}, prune []string) (eval *spruce.Evaluator, err error) {
 	evaluator := &spruce.Evaluator{
 		Tree:     data,
 		SkipEval: false,
@@ -15,23 +51,97 @@ func SpruceEval(data map[interface{}]interface{}, prune []string) (eval *spruce.
 
 	err = evaluator.Run(prune, nil)
 	if err != nil {
-		return evaluator, err
+		return evaluator, spruceError(err)
 	}
 
 	return evaluator, nil
 }
 
+// Run Spruce Eval of data with the given operators (see findOperators) and
+// return the evaluated tree. Data without stateful operators is evaluated
+// without the lock, so multiple manifests are evaluated in parallel.
+func SpruceEvalOperators(data map[interface{}]interface{}, prune []string, operators []string) (map[interface{}]interface{}, error) {
+	for _, op := range operators {
+		if statefulOperators[operatorName(op)] {
+			eval, err := SpruceEval(data, prune)
+			if err != nil {
+				return nil, err
+			}
+			return eval.Tree, nil
+		}
+	}
+
+	evaluator := &spruce.Evaluator{Tree: data}
+	if err := runStateless(evaluator, prune); err != nil {
+		return nil, spruceError(err)
+	}
+	return evaluator.Tree, nil
+}
+
+// runs the phases of spruce.Evaluator.Run without the setup of the operators
+// and the package level paths to prune and sort, the given paths are pruned
+func runStateless(evaluator *spruce.Evaluator, prune []string) error {
+	errs := spruce.MultiError{Errors: []error{}}
+	errs.Append(runPhase(evaluator, spruce.MergePhase))
+	if err := runPhase(evaluator, spruce.ParamPhase); err != nil {
+		return err
+	}
+	errs.Append(runPhase(evaluator, spruce.EvalPhase))
+
+	if err := evaluator.CheckForCycles(4096); err != nil {
+		return err
+	}
+	errs.Append(evaluator.Prune(prune))
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func runPhase(evaluator *spruce.Evaluator, phase spruce.OperatorPhase) error {
+	ops, err := evaluator.DataFlow(phase)
+	if err != nil {
+		return err
+	}
+	return evaluator.RunOps(ops)
+}
+
+// name of the operator within "(( name args ))"
+func operatorName(op string) string {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(op), "(("), "))"))
+	if len(fields) == 0 {
+		return ""
+	}
+	name, _, _ := strings.Cut(fields[0], "(")
+	return name
+}
+
 // Trys with eval, if fails, try without eval and trys to return the data tree
 func SpruceOptimisticEval(data map[interface{}]interface{}, prune []string) (tree map[interface{}]interface{}, err error) {
-	evaluator, err := SpruceEval(data, prune)
+	spruceMu.Lock()
+	defer spruceMu.Unlock()
+
+	evaluator, err := spruceEval(data, prune)
 	if err != nil {
 		// attempt without Evaluation
 		evaluator.SkipEval = true
 		err = evaluator.Run(prune, nil)
 		if err != nil {
-			return nil, fmt.Errorf("optimistic eval failed: %s", err)
+			return nil, fmt.Errorf("optimistic eval failed: %w", spruceError(err))
 		}
 	}
 
 	return evaluator.Tree, nil
 }
+
+// splits the errors of spruce into located errors (one per YAML path)
+func spruceError(err error) error {
+	var multi spruce.MultiError
+	if errors.As(err, &multi) {
+		return utils.PathErrors(multi.Errors)
+	}
+	if err != nil {
+		return utils.PathErrors([]error{err})
+	}
+	return nil
+}
@@ -5,8 +5,10 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/bedag/subst/internal/utils"
 	"github.com/rs/zerolog/log"
 	flag "github.com/spf13/pflag"
 
@@ -15,19 +17,63 @@ import (
 )
 
 type Configuration struct {
-	EnvRegex          string        `mapstructure:"env-regex"`
-	RootDirectory     string        `mapstructure:"root-dir"`
-	FileRegex         string        `mapstructure:"file-regex"`
-	SecretSkip        bool          `mapstructure:"secret-skip"`
-	SecretName        string        `mapstructure:"secret-name"`
-	SecretNamespace   string        `mapstructure:"secret-namespace"`
-	EjsonKey          []string      `mapstructure:"ejson-key"`
-	SkipDecrypt       bool          `mapstructure:"skip-decrypt"`
-	KubectlTimeout    time.Duration `mapstructure:"kubectl-timeout"`
-	Kubeconfig        string        `mapstructure:"kubeconfig"`
-	KubeAPI           string        `mapstructure:"kube-api"`
-	Output            string        `mapstructure:"output"`
-	ConvertSecretname bool          `mapstructure:"convert-secret-name"`
+	EnvRegex            string        `mapstructure:"env-regex"`
+	RootDirectory       string        `mapstructure:"root-dir"`
+	FileRegex           string        `mapstructure:"file-regex"`
+	SecretSkip          bool          `mapstructure:"secret-skip"`
+	SecretName          string        `mapstructure:"secret-name"`
+	SecretNamespace     string        `mapstructure:"secret-namespace"`
+	Secrets             []string      `mapstructure:"secret"`
+	SecretSelector      string        `mapstructure:"secret-selector"`
+	RequireSecret       bool          `mapstructure:"require-secret"`
+	EjsonKey            []string      `mapstructure:"ejson-key"`
+	KeySources          []string      `mapstructure:"key-source"`
+	Decryptors          []string      `mapstructure:"decryptor"`
+	SkipDecrypt         bool          `mapstructure:"skip-decrypt"`
+	SkipSchema          bool          `mapstructure:"skip-schema"`
+	KubectlTimeout      time.Duration `mapstructure:"kubectl-timeout"`
+	Kubeconfig          string        `mapstructure:"kubeconfig"`
+	KubeAPI             string        `mapstructure:"kube-api"`
+	Output              string        `mapstructure:"output"`
+	CacheDir            string        `mapstructure:"cache-dir"`
+	Validate            bool          `mapstructure:"validate"`
+	ValidateStrict      bool          `mapstructure:"validate-strict"`
+	CRDDirs             []string      `mapstructure:"crd-dir"`
+	SecretPolicy        string        `mapstructure:"secret-policy"`
+	SecretAllow         []string      `mapstructure:"secret-allow"`
+	RevealSecrets       bool          `mapstructure:"reveal-secrets"`
+	RedactSalt          string        `mapstructure:"redact-salt"`
+	SubstFromConfigMap  []string      `mapstructure:"subst-from-configmap"`
+	SubstFromSecret     []string      `mapstructure:"subst-from-secret"`
+	SubstFromPrecedence string        `mapstructure:"subst-from-precedence"`
+	VaultAddr           string        `mapstructure:"vault-addr"`
+	VaultNamespace      string        `mapstructure:"vault-namespace"`
+	VaultAuth           string        `mapstructure:"vault-auth"`
+	VaultAuthMount      string        `mapstructure:"vault-auth-mount"`
+	VaultRole           string        `mapstructure:"vault-role"`
+	ConvertSecretname   bool          `mapstructure:"convert-secret-name"`
+	// Sources of substFrom blocks in sandboxed substitution files
+	// (<kind>:<namespace>/<name>, the name may be a glob)
+	AllowSubstFrom []string `mapstructure:"allow-subst-from"`
+	// Vault paths (and their children) sandboxed substitution files may
+	// reference
+	AllowVaultPaths []string `mapstructure:"allow-vault-path"`
+	// Directory of untrusted inputs (eg. an uploaded archive) the render is
+	// confined to, unrestricted if empty
+	Sandbox string `mapstructure:"-"`
+	// Environment of the render (eg. variables exposed to the substitutions,
+	// filtered by EnvRegex), the process environment is never read directly
+	Env map[string]string `mapstructure:"-"`
+}
+
+// Environ returns the process environment as map
+func Environ() map[string]string {
+	env := make(map[string]string)
+	for _, e := range os.Environ() {
+		key, value, _ := strings.Cut(e, "=")
+		env[key] = value
+	}
+	return env
 }
 
 func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*Configuration, error) {
@@ -42,6 +88,21 @@ func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*C
 		}
 	})
 
+	// Parameters of the Argo CD application (PARAM_*) overwrite the
+	// defaults, flags given on the command line take precedence
+	env := Environ()
+	values, err := parameterValues(cmd.Flags(), env)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if cmd.Flags().Changed(name) {
+			delete(values, name)
+			continue
+		}
+		v.Set(name, value)
+	}
+
 	cfg := &Configuration{}
 	if err := v.Unmarshal(cfg); err != nil {
 		return nil, fmt.Errorf("failed unmarshaling configuration: %w", err)
@@ -49,9 +110,26 @@ func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*C
 
 	// Root Directory
 	cfg.RootDirectory = directory
+	cfg.Env = env
 
+	if err := cfg.ResolveSecret(); err != nil {
+		return nil, err
+	}
+	if err := checkParameterSecrets(cfg, values); err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("Configuration: %+v\n", cfg.Redacted())
+	return cfg, nil
+
+}
+
+// ResolveSecret derives the Secret holding the decryption keys from the Argo
+// CD application (ARGOCD_APP_NAME, ARGOCD_APP_NAMESPACE in Env), unless it is
+// configured, and validates the Secret configuration
+func (cfg *Configuration) ResolveSecret() error {
 	if cfg.SecretName == "" {
-		cfg.SecretName = os.Getenv("ARGOCD_APP_NAME")
+		cfg.SecretName = cfg.Env["ARGOCD_APP_NAME"]
 	}
 
 	if cfg.SecretName != "" {
@@ -65,21 +143,55 @@ func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*C
 	}
 
 	if cfg.SecretNamespace == "" {
-		cfg.SecretNamespace = os.Getenv("ARGOCD_APP_NAMESPACE")
+		cfg.SecretNamespace = cfg.Env["ARGOCD_APP_NAMESPACE"]
 	}
 
 	if cfg.SecretName != "" && cfg.SecretNamespace == "" {
-		return nil, fmt.Errorf("secret-namespace must be set when --secret-name is set")
+		return fmt.Errorf("secret-namespace must be set when --secret-name is set")
 	}
 
-	log.Debug().Msgf("Configuration: %+v\n", cfg)
-	return cfg, nil
+	if cfg.SecretSelector != "" && cfg.SecretNamespace == "" {
+		return fmt.Errorf("secret-namespace must be set when --secret-selector is set")
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the private keys
+// redacted. Only the environment variables matching EnvRegex (exposed to the
+// substitutions) are kept as they are, the values of the others and of the
+// variables holding key material or credentials are redacted.
+func (cfg *Configuration) Redacted() *Configuration {
+	c := *cfg
+	c.EjsonKey = make([]string, len(cfg.EjsonKey))
+	for i, key := range cfg.EjsonKey {
+		c.EjsonKey[i] = utils.Redact(key)
+	}
+	if cfg.RedactSalt != "" {
+		c.RedactSalt = utils.Redact(cfg.RedactSalt)
+	}
 
+	secret := map[string]bool{"VAULT_TOKEN": true, "VAULT_SECRET_ID": true}
+	for _, source := range cfg.KeySources {
+		if name, ok := strings.CutPrefix(source, "env:"); ok {
+			secret[name] = true
+		}
+	}
+	// An invalid regex exposes no variables
+	exposed, _ := regexp.Compile(cfg.EnvRegex)
+	c.Env = make(map[string]string, len(cfg.Env))
+	for name, value := range cfg.Env {
+		if secret[name] || exposed == nil || !exposed.MatchString(name) {
+			value = utils.Redact(value)
+		}
+		c.Env[name] = value
+	}
+	return &c
 }
 
 func PrintConfiguration(cfg *Configuration) {
 	fmt.Fprintln(os.Stderr, " Configuration")
-	e := reflect.ValueOf(cfg).Elem()
+	e := reflect.ValueOf(cfg.Redacted()).Elem()
 	typeOfCfg := e.Type()
 
 	for i := 0; i < e.NumField(); i++ {
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedacted(t *testing.T) {
+	cfg := &Configuration{
+		EnvRegex:   "^ARGOCD_ENV_.*$",
+		KeySources: []string{"env:ARGOCD_ENV_KEY"},
+		EjsonKey:   []string{"private"},
+		Env: map[string]string{
+			"ARGOCD_ENV_CLUSTER": "cluster-01",
+			"ARGOCD_ENV_KEY":     "key",
+			"AWS_SECRET_KEY":     "credential",
+		},
+	}
+
+	redacted := cfg.Redacted()
+	assert.Equal(t, map[string]string{
+		"ARGOCD_ENV_CLUSTER": "cluster-01",
+		"ARGOCD_ENV_KEY":     utils.Redact("key"),
+		"AWS_SECRET_KEY":     utils.Redact("credential"),
+	}, redacted.Env)
+	assert.Equal(t, []string{utils.Redact("private")}, redacted.EjsonKey)
+	assert.Equal(t, "credential", cfg.Env["AWS_SECRET_KEY"])
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// ParameterAnnouncement describes a parameter of the Argo CD config management
+// plugin, Argo CD shows them in the parameters tab of the application
+// (see https://argo-cd.readthedocs.io/en/stable/operator-manual/config-management-plugins/#parameters)
+type ParameterAnnouncement struct {
+	Name           string   `json:"name"`
+	Title          string   `json:"title,omitempty"`
+	Tooltip        string   `json:"tooltip,omitempty"`
+	Required       bool     `json:"required,omitempty"`
+	ItemType       string   `json:"itemType,omitempty"`
+	CollectionType string   `json:"collectionType,omitempty"`
+	String         string   `json:"string,omitempty"`
+	Array          []string `json:"array,omitempty"`
+}
+
+// parameter exposed to Argo CD, the name is the name of the flag
+type parameter struct {
+	name  string
+	title string
+}
+
+// parameters which can be set on the Argo CD application. The namespace of
+// the Secrets is not a parameter, Secrets selected by parameters must be in
+// the namespace of the application (see checkParameterSecrets).
+var parameters = []parameter{
+	{name: "file-regex", title: "Substitution files regex"},
+	{name: "require-secret", title: "Strict mode (fail without decryption keys)"},
+	{name: "output", title: "Output format (yaml, json)"},
+	{name: "secret-name", title: "Secret with decryption keys"},
+	{name: "secret", title: "Additional Secrets ([<namespace>/]<name>) with decryption keys"},
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// ParameterEnv returns the name of the environment variable Argo CD sets
+// for the parameter (eg. PARAM_FILE_REGEX)
+func ParameterEnv(name string) string {
+	return "PARAM_" + strings.ToUpper(nonAlphanumeric.ReplaceAllString(name, "_"))
+}
+
+// Parameters returns the announcement of the parameters, the defaults and
+// tooltips are taken from the flags
+func Parameters(flags *flag.FlagSet) []ParameterAnnouncement {
+	var announcements []ParameterAnnouncement
+	for _, p := range parameters {
+		f := flags.Lookup(p.name)
+		if f == nil {
+			continue
+		}
+		announcement := ParameterAnnouncement{
+			Name:    p.name,
+			Title:   p.title,
+			Tooltip: strings.Join(strings.Fields(f.Usage), " "),
+		}
+		switch f.Value.Type() {
+		case "stringSlice":
+			announcement.CollectionType = "array"
+			announcement.Array, _ = flags.GetStringSlice(p.name)
+		case "bool":
+			announcement.ItemType = "boolean"
+			announcement.String = f.DefValue
+		default:
+			announcement.ItemType = "string"
+			announcement.String = f.DefValue
+		}
+		announcements = append(announcements, announcement)
+	}
+	return announcements
+}
+
+// returns the values of the parameters set by Argo CD in the environment.
+// Arrays are set as PARAM_<NAME>_<INDEX>.
+func parameterValues(flags *flag.FlagSet, env map[string]string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, p := range parameters {
+		f := flags.Lookup(p.name)
+		if f == nil {
+			continue
+		}
+		name := ParameterEnv(p.name)
+		switch f.Value.Type() {
+		case "stringSlice":
+			items := arrayParameter(env, name)
+			if items != nil {
+				values[p.name] = items
+			}
+		case "bool":
+			if value, ok := env[name]; ok && value != "" {
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid parameter %s: %w", p.name, err)
+				}
+				values[p.name] = b
+			}
+		default:
+			if value, ok := env[name]; ok && value != "" {
+				values[p.name] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// Parameters are set by the authors of applications, the Secrets they select
+// must be in the namespace of the application (ARGOCD_APP_NAMESPACE), so an
+// application can not read the keys of another application
+func checkParameterSecrets(cfg *Configuration, values map[string]interface{}) error {
+	appNamespace := cfg.Env["ARGOCD_APP_NAMESPACE"]
+	if _, ok := values["secret-name"]; ok && (appNamespace == "" || cfg.SecretNamespace != appNamespace) {
+		return fmt.Errorf("parameter secret-name is only allowed for Secrets in the namespace of the application (%s)", ParameterEnv("secret-name"))
+	}
+	if _, ok := values["secret"]; ok {
+		for _, ref := range cfg.Secrets {
+			namespace, _, found := strings.Cut(ref, "/")
+			if !found {
+				namespace = cfg.SecretNamespace
+			}
+			if appNamespace == "" || namespace != appNamespace {
+				return fmt.Errorf("parameter secret %q is not in the namespace of the application (%s)", ref, ParameterEnv("secret"))
+			}
+		}
+	}
+	return nil
+}
+
+func arrayParameter(env map[string]string, name string) []string {
+	indexed := make(map[int]string)
+	for key, value := range env {
+		suffix, ok := strings.CutPrefix(key, name+"_")
+		if !ok {
+			continue
+		}
+		if i, err := strconv.Atoi(suffix); err == nil && value != "" {
+			indexed[i] = value
+		}
+	}
+	if len(indexed) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(indexed))
+	for i := range indexed {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	items := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		items = append(items, indexed[i])
+	}
+	return items
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func parametersCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "render"}
+	cmd.Flags().String("file-regex", `subst\.yaml`, "Regex Pattern to discover substitution files")
+	cmd.Flags().Bool("require-secret", false, "Fail if decryption keys can not be read")
+	cmd.Flags().String("output", "yaml", "Output format")
+	cmd.Flags().StringSlice("secret", []string{}, "Additional Secret")
+	return cmd
+}
+
+func TestParameters(t *testing.T) {
+	announcements := Parameters(parametersCmd().Flags())
+	assert.Equal(t, []ParameterAnnouncement{
+		{Name: "file-regex", Title: "Substitution files regex", Tooltip: "Regex Pattern to discover substitution files", ItemType: "string", String: `subst\.yaml`},
+		{Name: "require-secret", Title: "Strict mode (fail without decryption keys)", Tooltip: "Fail if decryption keys can not be read", ItemType: "boolean", String: "false"},
+		{Name: "output", Title: "Output format (yaml, json)", Tooltip: "Output format", ItemType: "string", String: "yaml"},
+		{Name: "secret", Title: "Additional Secrets ([<namespace>/]<name>) with decryption keys", Tooltip: "Additional Secret", CollectionType: "array", Array: []string{}},
+	}, announcements)
+	assert.Equal(t, "PARAM_FILE_REGEX", ParameterEnv("file-regex"))
+}
+
+func TestLoadConfigurationParameters(t *testing.T) {
+	t.Setenv("PARAM_FILE_REGEX", `values\.yaml`)
+	t.Setenv("PARAM_REQUIRE_SECRET", "true")
+	t.Setenv("PARAM_OUTPUT", "json")
+	t.Setenv("ARGOCD_APP_NAMESPACE", "team")
+	t.Setenv("PARAM_SECRET_1", "team/shared")
+	t.Setenv("PARAM_SECRET_0", "keys")
+
+	cmd := parametersCmd()
+	// Flags take precedence over parameters
+	assert.NoError(t, cmd.Flags().Set("output", "yaml"))
+	cfg, err := LoadConfiguration("", cmd, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, `values\.yaml`, cfg.FileRegex)
+	assert.True(t, cfg.RequireSecret)
+	assert.Equal(t, "yaml", cfg.Output)
+	assert.Equal(t, []string{"keys", "team/shared"}, cfg.Secrets)
+
+	t.Setenv("PARAM_REQUIRE_SECRET", "yes please")
+	_, err = LoadConfiguration("", parametersCmd(), ".")
+	assert.Error(t, err)
+}
+
+func TestParameterSecretsOfOtherNamespaces(t *testing.T) {
+	t.Setenv("ARGOCD_APP_NAME", "app")
+	t.Setenv("ARGOCD_APP_NAMESPACE", "team")
+
+	// Secrets of other namespaces can not be selected with parameters
+	t.Setenv("PARAM_SECRET_0", "other-team/other-app")
+	cmd := parametersCmd()
+	_, err := LoadConfiguration("", cmd, ".")
+	assert.ErrorContains(t, err, "PARAM_SECRET")
+
+	// The namespace is not a parameter
+	t.Setenv("PARAM_SECRET_0", "")
+	t.Setenv("PARAM_SECRET_NAMESPACE", "other-team")
+	t.Setenv("PARAM_SECRET_NAME", "other-app")
+	cmd = parametersCmd()
+	cmd.Flags().String("secret-name", "", "Secret")
+	cmd.Flags().String("secret-namespace", "", "Namespace of the Secret")
+	cfg, err := LoadConfiguration("", cmd, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, "other-app", cfg.SecretName)
+	assert.Equal(t, "team", cfg.SecretNamespace)
+
+	// Unless set by the operator, the namespace of the application is used
+	cmd = parametersCmd()
+	cmd.Flags().String("secret-name", "", "Secret")
+	cmd.Flags().String("secret-namespace", "", "Namespace of the Secret")
+	assert.NoError(t, cmd.Flags().Set("secret-namespace", "argocd"))
+	_, err = LoadConfiguration("", cmd, ".")
+	assert.ErrorContains(t, err, "PARAM_SECRET_NAME")
+
+	// Flags of the operator are not restricted
+	assert.NoError(t, cmd.Flags().Set("secret-name", "shared"))
+	cfg, err = LoadConfiguration("", cmd, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, "argocd", cfg.SecretNamespace)
+}
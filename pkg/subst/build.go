@@ -1,17 +1,36 @@
 package subst
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bedag/subst/internal/cache"
 	decrypt "github.com/bedag/subst/internal/decryptors"
 	ejson "github.com/bedag/subst/internal/decryptors/ejson"
+	_ "github.com/bedag/subst/internal/decryptors/exec"
+	"github.com/bedag/subst/internal/kube"
 	"github.com/bedag/subst/internal/kustomize"
 	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/vault"
 	"github.com/bedag/subst/pkg/config"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/api/resource"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 type Build struct {
@@ -19,39 +38,69 @@ type Build struct {
 	Kustomization *kustomize.Kustomize
 	Substitutions *Substitutions
 	cfg           config.Configuration
-	kubeClient    *kubernetes.Clientset
+	kubeClient    kubernetes.Interface
+	kubeConfig    *rest.Config
+	layouts       []*kyaml.Node
+	// failed key lookups of the decryptor initialization
+	keyLookups []error
+	// decryptors are initialized once per build
+	decrypts       []decrypt.Decryptor
+	decryptsLoaded bool
+	cleanups       []func()
+	closeOnce      sync.Once
+	// digest of the key material loaded into the decryptors
+	keyDigest hash.Hash
+	// set if a decryptor may decrypt with key material which is not
+	// covered by the digest
+	keysUnknown bool
+	// keeps keys of Kubernetes Secrets across builds (optional)
+	keyCache *KeyCache
+	log      zerolog.Logger
 }
 
-func New(config config.Configuration) (build *Build, err error) {
+// New runs the kustomize build of the configured root directory. Options are
+// applied on top of the configuration.
+func New(ctx context.Context, config config.Configuration, opts ...Option) (build *Build, err error) {
+	o := newOptions(config, opts)
+	if err := ctx.Err(); err != nil {
+		return nil, stepError("kustomize build", err)
+	}
 
-	k, err := kustomize.NewKustomize(config.RootDirectory)
+	var k *kustomize.Kustomize
+	if o.cfg.Sandbox != "" {
+		k, err = kustomize.NewSandboxedKustomize(o.cfg.RootDirectory, o.cfg.Sandbox)
+	} else {
+		k, err = kustomize.NewKustomize(o.cfg.RootDirectory)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	init := &Build{
-		cfg:           config,
+		cfg:           o.cfg,
 		Kustomization: k,
+		kubeClient:    o.kubeClient,
+		keyCache:      o.keyCache,
+		log:           o.logger,
 	}
 
 	return init, err
 }
 
-func (b *Build) BuildSubstitutions() (err error) {
-	decryptors, cleanups, err := b.decryptors()
+func (b *Build) BuildSubstitutions(ctx context.Context) (err error) {
+	defer func() { err = b.Substitutions.redactError(err) }()
+
+	decryptors, err := b.decryptors(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		for _, cleanup := range cleanups {
-			cleanup()
-		}
-	}()
-
 	SubstitutionsConfig := SubstitutionsConfig{
 		EnvironmentRegex: b.cfg.EnvRegex,
 		SubstFileRegex:   b.cfg.FileRegex,
+		Environment:      b.cfg.Env,
+		Logger:           &b.log,
+		SourcePrecedence: b.cfg.SubstFromPrecedence,
 	}
 
 	b.Substitutions, err = NewSubstitutions(SubstitutionsConfig, decryptors, b.Kustomization.Build)
@@ -59,7 +108,31 @@ func (b *Build) BuildSubstitutions() (err error) {
 		return err
 	}
 
-	err = b.loadSubstitutions()
+	b.Substitutions.vault, err = b.vaultClient()
+	if err != nil {
+		return err
+	}
+	b.Substitutions.kubeClient = b.client
+	b.Substitutions.kubeTimeout = b.cfg.KubectlTimeout
+	b.Substitutions.keyLookups = b.keyLookups
+	b.Substitutions.skipDecrypt = b.cfg.SkipDecrypt
+	b.Substitutions.redactKey = b.redactKey()
+	if b.cfg.Sandbox != "" {
+		b.Substitutions.sandbox = &sandbox{
+			sources:    b.cfg.AllowSubstFrom,
+			vaultPaths: b.cfg.AllowVaultPaths,
+		}
+		// The environment includes the environment of the server
+		delete(b.Substitutions.funcmap, "env")
+		delete(b.Substitutions.funcmap, "expandenv")
+	}
+
+	err = b.addSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.loadSubstitutions(ctx)
 	if err != nil {
 		return err
 	}
@@ -67,74 +140,315 @@ func (b *Build) BuildSubstitutions() (err error) {
 
 }
 
-func (b *Build) Build() (err error) {
+func (b *Build) Build(ctx context.Context) (err error) {
+	defer func() { err = b.Substitutions.redactError(err) }()
 
 	if b.Substitutions == nil {
-		log.Debug().Msg("no resources to build")
+		b.log.Debug().Msg("no resources to build")
 		return nil
 	}
 
-	decryptors, cleanups, err := b.decryptors()
+	decryptors, err := b.decryptors(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		for _, cleanup := range cleanups {
-			cleanup()
+	// Run Build
+	b.log.Debug().Msg("substitute manifests")
+
+	// Manifests are evaluated by a pool of workers, the results are
+	// collected by index to keep the order of the resources
+	resources := b.Substitutions.Resources.Resources()
+	manifests := make([]map[interface{}]interface{}, len(resources))
+	errs := make([]error, len(resources))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers(len(resources)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				manifests[i], errs[i] = b.buildManifest(decryptors, resources[i])
+			}
+		}()
+	}
+
+feed:
+	for i := range resources {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
 		}
-	}()
+	}
+	close(jobs)
+	wg.Wait()
 
-	// Run Build
-	log.Debug().Msg("substitute manifests")
+	if err := ctx.Err(); err != nil {
+		return stepError("substitution of manifests", err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
 
-	for _, manifest := range b.Substitutions.Resources.Resources() {
-		var c map[interface{}]interface{}
+	for i, manifest := range resources {
+		b.Manifests = append(b.Manifests, manifests[i])
+		b.layouts = append(b.layouts, manifest.YNode())
+	}
 
-		mBytes, _ := manifest.MarshalJSON()
-		for _, d := range decryptors {
-			isEncrypted, err := d.IsEncrypted(mBytes)
+	if err := b.checkSecrets(resources); err != nil {
+		return err
+	}
+
+	if b.cfg.Validate {
+		return b.validateManifests(resources)
+	}
+	return nil
+}
+
+// decrypts (if encrypted) and evaluates a single manifest
+func (b *Build) buildManifest(decryptors []decrypt.Decryptor, manifest *resource.Resource) (f map[interface{}]interface{}, err error) {
+	id := resourceID(manifest)
+	defer func() {
+		if err != nil {
+			b.log.Error().Msgf("failed to build %s: %s", id, b.Substitutions.redactError(err))
+			err = b.locateManifestError(err, id, manifest)
+		}
+	}()
+	var c map[interface{}]interface{}
+
+	mBytes, _ := manifest.MarshalJSON()
+	for _, d := range decryptors {
+		isEncrypted, err := d.IsEncrypted(mBytes)
+		if err != nil {
+			return nil, err
+		}
+		if isEncrypted {
+			dm, err := d.Decrypt(mBytes)
 			if err != nil {
-				log.Error().Msgf("Error checking encryption for %s: %s", mBytes, err)
-				return err
+				return nil, withKeyLookups(err, b.keyLookups)
 			}
-			if isEncrypted {
-				dm, err := d.Decrypt(mBytes)
-				if err != nil {
-					log.Error().Msgf("failed to decrypt %s: %s", mBytes, err)
-					return err
+			c = utils.ToInterface(dm)
+			break
+		}
+	}
+
+	if c == nil {
+		m, _ := manifest.AsYAML()
+
+		c, err = utils.ParseYAML(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Manifests (including the resources of substitution files) are evaluated
+	// like substitution files and must not read from outside of the sandbox
+	if b.Substitutions.sandbox != nil {
+		if err := b.Substitutions.sandbox.operators("$", c); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Substitutions.EvalManifest(c)
+}
+
+// identifies the resource in errors
+func resourceID(manifest *resource.Resource) string {
+	return fmt.Sprintf("%s %s/%s", manifest.GetKind(), manifest.GetNamespace(), manifest.GetName())
+}
+
+// adds the resource and (if found) the source file of the manifest to the
+// error. Kustomize does not keep the origin of resources, the source is looked
+// up within the kustomize paths.
+func (b *Build) locateManifestError(err error, id string, manifest *resource.Resource) error {
+	var files []string
+	if b.Kustomization != nil {
+		for _, path := range b.Kustomization.Paths {
+			entries, _ := os.ReadDir(path)
+			for _, entry := range entries {
+				ext := filepath.Ext(entry.Name())
+				if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+					files = append(files, filepath.Join(path, entry.Name()))
 				}
-				c = utils.ToInterface(dm)
-				break
 			}
 		}
+	}
 
-		if c == nil {
-			m, _ := manifest.AsYAML()
+	return utils.WithSource(err, func(e *utils.SourceError) {
+		e.Resource = id
+		for _, file := range files {
+			data, readErr := os.ReadFile(file)
+			if readErr == nil && e.LocateResource(data, manifest.GetKind(), manifest.GetName()) {
+				e.File = file
+				return
+			}
+		}
+	})
+}
 
-			c, err = utils.ParseYAML(m)
-			if err != nil {
-				log.Error().Msgf("UnmarshalJSON: %s", err)
-				return err
+// number of workers for the given amount of jobs, bound by GOMAXPROCS
+// (which respects --maxprocs)
+func workers(jobs int) int {
+	n := runtime.GOMAXPROCS(0)
+	if jobs < n {
+		n = jobs
+	}
+	return n
+}
+
+// CacheKey returns the key of the render in the cache and the secret to
+// encrypt the cache entry with. The key covers the files of the kustomize
+// paths, the kustomize build, the exposed environment variables, the
+// configuration (including the CRD directories of the validation and the
+// restrictions of sandboxed builds) and a fingerprint of the loaded keys (a
+// rotated key invalidates the entries). The secret is derived from the loaded
+// keys.
+func (b *Build) CacheKey(ctx context.Context) (key string, secret []byte, err error) {
+	if _, err = b.decryptors(ctx); err != nil {
+		return "", nil, err
+	}
+
+	h := cache.NewHash()
+	for _, path := range b.Kustomization.Paths {
+		if err = h.AddFiles(path); err != nil {
+			return "", nil, err
+		}
+	}
+	resources, err := b.Kustomization.Build.AsYaml()
+	if err != nil {
+		return "", nil, err
+	}
+	h.Add("build", resources)
+
+	envs, err := Variables(b.cfg.Env, b.cfg.EnvRegex)
+	if err != nil {
+		return "", nil, err
+	}
+	h.AddMap("env", envs)
+	h.Add("config", []byte(fmt.Sprintf("%s|%s|%s|%t|%v|%s|%v|%t|%t|%t|%v", b.cfg.FileRegex, b.cfg.EnvRegex, b.cfg.Output, b.cfg.SkipDecrypt, b.cfg.Decryptors, b.cfg.SecretPolicy, b.cfg.SecretAllow, b.cfg.SkipSchema, b.cfg.Validate, b.cfg.ValidateStrict, b.cfg.CRDDirs)))
+	// Sandboxed builds fail for sources and vault paths which are not allowed
+	h.Add("sandbox", []byte(fmt.Sprintf("%t|%v|%v", b.cfg.Sandbox != "", b.cfg.AllowSubstFrom, b.cfg.AllowVaultPaths)))
+	// Manifests are validated against the CustomResourceDefinitions of the
+	// directories
+	if b.cfg.Validate {
+		for _, dir := range b.cfg.CRDDirs {
+			if err = h.AddTree(dir); err != nil {
+				return "", nil, err
 			}
 		}
+	}
+
+	secret = b.keyDigest.Sum(nil)
+	fingerprint := sha256.Sum256(append([]byte("subst-cache-fingerprint\x00"), secret...))
+	h.Add("keys", fingerprint[:])
+	return h.Sum(), secret, nil
+}
+
+// key of the placeholders of secret values, derived from the configured salt
+// or the loaded decryption keys, so placeholders are comparable across runs.
+// Without either, the key is random for the process (see utils.Redact).
+func (b *Build) redactKey() []byte {
+	if b.cfg.RedactSalt != "" {
+		return utils.RedactKey([]byte("salt\x00" + b.cfg.RedactSalt))
+	}
+	if b.keyDigest == nil {
+		return nil
+	}
+	digest := b.keyDigest.Sum(nil)
+	if empty := sha256.Sum256(nil); bytes.Equal(digest, empty[:]) {
+		return nil
+	}
+	return utils.RedactKey(append([]byte("keys\x00"), digest...))
+}
 
-		f, err := b.Substitutions.Eval(c, nil, false)
+// Cacheable reports if the render only depends on the inputs covered by the
+// cache key. Substitutions from Vault or the cluster are not covered, neither
+// are decryptors with key material unknown to subst (eg. exec without keys),
+// which are detected once the decryptors are initialized (see CacheKey).
+func (b *Build) Cacheable() bool {
+	if b.cfg.VaultAddr != "" || len(b.cfg.SubstFromConfigMap) > 0 || len(b.cfg.SubstFromSecret) > 0 || b.keysUnknown {
+		return false
+	}
+	return b.Substitutions == nil || !b.Substitutions.external
+}
+
+// Layout returns the source node of the manifest at the given index, which
+// is used to restore the original field order when printing the manifest
+func (b *Build) Layout(i int) *kyaml.Node {
+	if i < 0 || i >= len(b.layouts) {
+		return nil
+	}
+	return b.layouts[i]
+}
+
+// Write writes the manifests to w in the configured output format (yaml or json)
+func (b *Build) Write(w io.Writer) error {
+	for i, manifest := range b.Manifests {
+		var err error
+		if b.cfg.Output == "json" {
+			err = utils.WriteJSON(w, manifest)
+		} else {
+			err = utils.WriteYAML(w, manifest, b.Layout(i))
+		}
 		if err != nil {
-			log.Error().Msgf("spruce evaluation failed %s/%s: %s", manifest.GetNamespace(), manifest.GetName(), err)
-			return err
+			return fmt.Errorf("failed to write manifest %d: %w", i, err)
 		}
-		b.Manifests = append(b.Manifests, f)
 	}
-
 	return nil
 }
 
+// WriteSubstitutions writes the substitutions to w in the configured output
+// format (yaml or json). Decrypted values are redacted, unless they are
+// revealed by configuration (which is logged for auditing).
+func (b *Build) WriteSubstitutions(w io.Writer) error {
+	if b.Substitutions == nil || len(b.Substitutions.Subst) == 0 {
+		return nil
+	}
+	subst := b.Substitutions.Subst
+	if b.cfg.RevealSecrets {
+		b.AuditReveal()
+	} else {
+		subst = b.Substitutions.redact(subst).(map[interface{}]interface{})
+	}
+	if b.cfg.Output == "json" {
+		return utils.WriteJSON(w, subst)
+	}
+	return utils.WriteYAML(w, subst, b.Substitutions.Layout())
+}
+
+// AuditReveal logs that secret values of the build were revealed, with the
+// user and the application (if rendered by Argo CD)
+func (b *Build) AuditReveal() {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	event := b.log.Warn().
+		Str("audit", "reveal-secrets").
+		Str("user", name).
+		Str("root", b.cfg.RootDirectory).
+		Int("values", len(b.Substitutions.secrets))
+	if app := b.cfg.Env["ARGOCD_APP_NAME"]; app != "" {
+		event = event.Str("application", app)
+	}
+	event.Msg("decrypted values revealed")
+}
+
 // builds the substitutions interface
-func (b *Build) loadSubstitutions() (err error) {
+func (b *Build) loadSubstitutions(ctx context.Context) (err error) {
 
 	// Read Substition Files
-	err = b.Kustomization.Walk(b.Substitutions.Walk)
+	err = b.Kustomization.Walk(func(path string, f fs.FileInfo) error {
+		return b.Substitutions.Walk(ctx, path, f)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sources with high precedence overwrite the files
+	err = b.Substitutions.applySources()
 	if err != nil {
 		return err
 	}
@@ -142,59 +456,352 @@ func (b *Build) loadSubstitutions() (err error) {
 	// Final attempt to evaluate
 	eval, err := b.Substitutions.Eval(b.Substitutions.Subst, nil, false)
 	if err != nil {
-		return fmt.Errorf("spruce evaluation failed: %s", err)
+		return b.Substitutions.locate(err)
 	}
 	b.Substitutions.Subst = eval
 
+	if !b.cfg.SkipSchema {
+		if err := b.Substitutions.validate(); err != nil {
+			return err
+		}
+	}
+
 	if len(b.Substitutions.Subst) > 0 {
-		log.Debug().Msgf("loaded substitutions: %+v", b.Substitutions.Subst)
+		b.log.Debug().Msgf("loaded substitutions: %+v", b.Substitutions.redact(b.Substitutions.Subst))
 	} else {
-		log.Debug().Msg("no substitutions found")
+		b.log.Debug().Msg("no substitutions found")
 	}
 
 	return nil
 }
 
+// adds the ConfigMaps and Secrets given by configuration as substitution
+// sources, ConfigMaps first, then Secrets (each in the given order)
+func (b *Build) addSources(ctx context.Context) error {
+	var refs []SourceRef
+	for _, r := range b.cfg.SubstFromConfigMap {
+		ref, err := ParseSourceRef(SourceConfigMap, r)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	for _, r := range b.cfg.SubstFromSecret {
+		ref, err := ParseSourceRef(SourceSecret, r)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+	for _, ref := range refs {
+		if err := b.Substitutions.AddSource(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close runs the cleanups of the build (once) and removes the loaded key
+// material from memory. Content can't be decrypted afterwards.
+func (b *Build) Close() {
+	b.closeOnce.Do(func() {
+		for _, cleanup := range b.cleanups {
+			cleanup()
+		}
+		b.cleanups = nil
+	})
+}
+
+// decryptors with their keys loaded, they are initialized once per build
+func (b *Build) decryptors(ctx context.Context) ([]decrypt.Decryptor, error) {
+	if b.decryptsLoaded {
+		return b.decrypts, nil
+	}
+	decryptors, err := b.newDecryptors(ctx)
+	if err != nil {
+		for _, d := range decryptors {
+			d.Close()
+		}
+		return nil, err
+	}
+	for _, d := range decryptors {
+		b.cleanups = append(b.cleanups, d.Close)
+	}
+	b.decrypts = decryptors
+	b.decryptsLoaded = true
+	return decryptors, nil
+}
+
 // initialize decryption
-func (b *Build) decryptors() (decryptors []decrypt.Decryptor, cleanups []func(), err error) {
+func (b *Build) newDecryptors(ctx context.Context) (decryptors []decrypt.Decryptor, err error) {
+	b.keyDigest = sha256.New()
 
 	c := decrypt.DecryptorConfig{
 		SkipDecrypt: b.cfg.SkipDecrypt,
+		Context:     ctx,
+		Logger:      &b.log,
+	}
+
+	// Decryptors are probed in the given order
+	for _, selection := range b.cfg.Decryptors {
+		d, err := decrypt.New(c, selection)
+		if err != nil {
+			return decryptors, err
+		}
+		decryptors = append(decryptors, d)
 	}
 
-	ed, err := ejson.NewEJSONDecryptor(c, "", b.cfg.EjsonKey...)
+	b.keyLookups = nil
+	if b.cfg.SkipDecrypt {
+		return
+	}
+
+	sources, err := b.keySources()
 	if err != nil {
-		return nil, nil, err
+		return decryptors, err
+	}
+
+	for _, source := range sources {
+		err = b.loadKeys(ctx, source, decryptors)
+		if err != nil {
+			if ctx.Err() != nil {
+				return decryptors, stepError(fmt.Sprintf("key lookup from %s", source), ctx.Err())
+			}
+			// Keys from Kubernetes are optional, unless required
+			var lookup *decrypt.KeyLookupError
+			switch source.(type) {
+			case *decrypt.SecretKeySource, *decrypt.SecretSelectorKeySource:
+				if errors.As(err, &lookup) {
+					err = b.keyLookupFailed(lookup)
+				}
+			}
+			if err != nil {
+				return decryptors, err
+			}
+		}
+	}
+
+	// Key material held by the decryptors themselves (eg. keys found on disk)
+	for _, d := range decryptors {
+		f, ok := d.(decrypt.KeyFingerprinter)
+		if !ok || !f.Fingerprint(b.keyDigest) {
+			b.keysUnknown = true
+		}
+	}
+
+	return decryptors, nil
+}
+
+// assembles the key sources from the configuration
+func (b *Build) keySources() (sources []decrypt.KeySource, err error) {
+	if len(b.cfg.EjsonKey) > 0 {
+		static := &decrypt.StaticKeySource{Origin: "flag --ejson-key"}
+		for i, key := range b.cfg.EjsonKey {
+			static.Entries = append(static.Entries, decrypt.Key{
+				Name:  fmt.Sprintf("ejson-key-%d%s", i, ejson.DecryptionEjsonExt),
+				Value: []byte(key),
+			})
+		}
+		sources = append(sources, static)
+	}
+
+	for _, ref := range b.cfg.KeySources {
+		source, err := decrypt.ParseKeySource(ref, b.cfg.Env)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
 	}
-	decryptors = append(decryptors, ed)
 
 	if b.cfg.SecretSkip {
-		return
+		return sources, nil
 	}
+	secrets, err := b.secretKeySources()
+	if err != nil {
+		return nil, err
+	}
+	return append(sources, secrets...), nil
+}
 
-	if !b.cfg.SkipDecrypt && (b.cfg.SecretName != "" && b.cfg.SecretNamespace != "") {
+// key sources from Kubernetes Secrets. The explicitly given Secrets are read
+// first, followed by the Secrets matching the selector and the Secret of the
+// application. Missing Secrets are skipped.
+func (b *Build) secretKeySources() (sources []decrypt.KeySource, err error) {
+	if len(b.cfg.Secrets) == 0 && b.cfg.SecretSelector == "" && (b.cfg.SecretName == "" || b.cfg.SecretNamespace == "") {
+		return nil, nil
+	}
 
-		var host string
-		if b.cfg.KubeAPI != "" {
-			host = b.cfg.KubeAPI
+	client, err := b.client()
+	if err != nil {
+		return nil, b.keyLookupFailed(decrypt.NewKeyLookupError("kubernetes", err))
+	}
+
+	for _, ref := range b.cfg.Secrets {
+		namespace, name, found := strings.Cut(ref, "/")
+		if !found {
+			namespace, name = b.cfg.SecretNamespace, ref
 		}
-		cfg, err := clientcmd.BuildConfigFromFlags(host, b.cfg.Kubeconfig)
-		if err == nil {
-			b.kubeClient, err = kubernetes.NewForConfig(cfg)
-			if err != nil {
-				log.Debug().Msgf("could not load kubernetes client: %s", err)
-			} else {
-				ctx := context.Background()
-				for _, decr := range decryptors {
-					err = decr.KeysFromSecret(b.cfg.SecretName, b.cfg.SecretNamespace, b.kubeClient, ctx)
-					if err != nil {
-						log.Debug().Msgf("failed to load secrets from Kubernetes: %s", err)
-					}
-				}
+		if namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid secret %q, expected [<namespace>/]<name> (or set --secret-namespace)", ref)
+		}
+		sources = append(sources, &decrypt.SecretKeySource{Name: name, Namespace: namespace, Client: client})
+	}
 
-			}
+	if b.cfg.SecretSelector != "" {
+		sources = append(sources, &decrypt.SecretSelectorKeySource{
+			Selector:  b.cfg.SecretSelector,
+			Namespace: b.cfg.SecretNamespace,
+			Client:    client,
+		})
+	}
+
+	if b.cfg.SecretName != "" && b.cfg.SecretNamespace != "" {
+		sources = append(sources, &decrypt.SecretKeySource{
+			Name:      b.cfg.SecretName,
+			Namespace: b.cfg.SecretNamespace,
+			Client:    client,
+		})
+	}
+	return sources, nil
+}
+
+// records a failed lookup of Kubernetes keys, which is only fatal
+// with --require-secret
+func (b *Build) keyLookupFailed(lookup *decrypt.KeyLookupError) error {
+	if b.cfg.RequireSecret {
+		return lookup
+	}
+	var missing *decrypt.MissingKubernetesSecret
+	if errors.As(lookup, &missing) {
+		b.log.Debug().Msg(lookup.Error())
+	} else {
+		b.log.Warn().Msg(lookup.Error())
+	}
+	b.keyLookups = append(b.keyLookups, lookup)
+	return nil
+}
+
+// adds the failed key lookups to errors about missing keys, as they
+// are the likely cause
+func withKeyLookups(err error, lookups []error) error {
+	var missing *decrypt.MissingKeyError
+	if errors.As(err, &missing) && len(missing.Lookups) == 0 {
+		missing.Lookups = lookups
+	}
+	return err
+}
+
+// reads the keys from the source and hands them to all decryptors
+func (b *Build) loadKeys(ctx context.Context, source decrypt.KeySource, decryptors []decrypt.Decryptor) error {
+	var keys []decrypt.Key
+	var err error
+	switch source.(type) {
+	case *decrypt.SecretKeySource, *decrypt.SecretSelectorKeySource:
+		var cancel context.CancelFunc
+		ctx, cancel = kubeContext(ctx, b.cfg.KubectlTimeout)
+		defer cancel()
+		if b.keyCache != nil {
+			keys, err = b.keyCache.keys(ctx, source)
+			break
 		}
+		keys, err = source.Keys(ctx)
+	default:
+		keys, err = source.Keys(ctx)
 	}
+	if err != nil {
+		return decrypt.NewKeyLookupError(source.String(), stepError(fmt.Sprintf("key lookup from %s", source), err))
+	}
+	for _, key := range keys {
+		fmt.Fprintf(b.keyDigest, "%d:", len(key.Value))
+		b.keyDigest.Write(key.Value)
+	}
+	// Decryptors keep their own copy of the keys
+	defer func() {
+		for _, key := range keys {
+			decrypt.Zero(key.Value)
+		}
+	}()
+	for _, d := range decryptors {
+		if err := d.LoadKeys(keys); err != nil {
+			return err
+		}
+	}
+	b.log.Debug().Msgf("loaded %d key(s) from %s", len(keys), source)
+	return nil
+}
+
+// vault client, nil if vault is not configured
+func (b *Build) vaultClient() (*vault.Client, error) {
+	if b.cfg.VaultAddr == "" {
+		return nil, nil
+	}
+	return vault.New(vault.Config{
+		Address:   b.cfg.VaultAddr,
+		Namespace: b.cfg.VaultNamespace,
+		Auth:      b.cfg.VaultAuth,
+		AuthMount: b.cfg.VaultAuthMount,
+		Role:      b.cfg.VaultRole,
+		Token:     b.cfg.Env["VAULT_TOKEN"],
+		RoleID:    b.cfg.Env["VAULT_ROLE_ID"],
+		SecretID:  b.cfg.Env["VAULT_SECRET_ID"],
+	})
+}
+
+// kubernetes client (created once)
+func (b *Build) client() (kubernetes.Interface, error) {
+	if b.kubeClient != nil {
+		return b.kubeClient, nil
+	}
+	cfg, err := b.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	b.kubeClient, err = kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.kubeClient, nil
+}
 
-	return
+// LiveResources returns a client to read resources from the cluster, it uses
+// the same connection as the lookup of decryption keys
+func (b *Build) LiveResources() (kube.Resources, error) {
+	cfg, err := b.restConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubernetes config: %w", err)
+	}
+	return kube.NewResources(cfg)
+}
+
+// kubernetes client configuration (created once)
+func (b *Build) restConfig() (*rest.Config, error) {
+	if b.kubeConfig != nil {
+		return b.kubeConfig, nil
+	}
+	cfg, err := kube.Config(b.cfg.Kubeconfig, b.cfg.KubeAPI)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = b.cfg.KubectlTimeout
+	b.kubeConfig = cfg
+	return cfg, nil
+}
+
+// applies the timeout for Kubernetes calls (if configured)
+func kubeContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// names the step which was interrupted by a timeout or cancellation
+func stepError(step string, err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%s timed out: %w", step, err)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%s was canceled: %w", step, err)
+	}
+	return err
 }
@@ -0,0 +1,373 @@
+package subst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"testing"
+	"time"
+
+	decrypt "github.com/bedag/subst/internal/decryptors"
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestKeyLookupFailures(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() == "denied" {
+			return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "denied", errors.New("rbac"))
+		}
+		return false, nil, nil
+	})
+	b := &Build{
+		cfg: config.Configuration{
+			Decryptors: []string{"ejson"},
+			Secrets:    []string{"argocd/missing", "argocd/denied"},
+		},
+		kubeClient: client,
+	}
+
+	// Without --require-secret the failures are recorded
+	decryptors, err := b.decryptors(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, b.keyLookups, 2)
+
+	encrypted, err := os.ReadFile("../../internal/decryptors/ejson/testdata/encrypted.ejson")
+	assert.NoError(t, err)
+	_, err = decryptors[0].Decrypt(encrypted)
+	err = withKeyLookups(err, b.keyLookups)
+	var missing *decrypt.MissingKeyError
+	assert.True(t, errors.As(err, &missing))
+	assert.NotEmpty(t, missing.PublicKey)
+	assert.Contains(t, err.Error(), "secret argocd/missing (not found)")
+	assert.Contains(t, err.Error(), "secret argocd/denied (access denied")
+
+	// With --require-secret the first failure is fatal
+	b = &Build{cfg: b.cfg, kubeClient: client}
+	b.cfg.RequireSecret = true
+	_, err = b.decryptors(context.Background())
+	var lookup *decrypt.KeyLookupError
+	assert.True(t, errors.As(err, &lookup))
+	assert.Equal(t, "secret argocd/missing", lookup.Source)
+	assert.Equal(t, "not found", lookup.Reason)
+}
+
+func TestBuildCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := New(ctx, config.Configuration{RootDirectory: "."})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), "kustomize build was canceled")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b := &Build{cfg: config.Configuration{
+		Decryptors: []string{"ejson"},
+		KeySources: []string{"exec:sleep 5"},
+	}}
+	_, err = b.decryptors(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "key lookup from exec sleep timed out")
+}
+
+func TestDecryptorsLoadedOnce(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "argocd"},
+		Data:       map[string][]byte{"app.key": []byte("65b2f2060e6e3a976456c5a7cbcca3f15715eb1d9e0fe54174fa7b36aca1f50e")},
+	})
+	b := &Build{
+		cfg:        config.Configuration{Decryptors: []string{"ejson"}, SecretName: "app", SecretNamespace: "argocd"},
+		kubeClient: client,
+	}
+
+	first, err := b.decryptors(context.Background())
+	assert.NoError(t, err)
+	second, err := b.decryptors(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, first[0], second[0])
+	assert.Len(t, client.Actions(), 1, "Expected the Secret to be read once")
+
+	encrypted, err := os.ReadFile("../../internal/decryptors/ejson/testdata/encrypted.ejson")
+	assert.NoError(t, err)
+	_, err = first[0].Decrypt(encrypted)
+	assert.NoError(t, err)
+
+	// Closing removes the keys, multiple calls are fine
+	b.Close()
+	b.Close()
+	_, err = first[0].Decrypt(encrypted)
+	assert.Error(t, err)
+}
+
+// kustomization with the given config maps, each referencing a substitution
+func testBundle(t testing.TB, values map[string]string, names ...string) string {
+	dir := t.TempDir()
+	kustomization := "resources:\n"
+	for _, name := range names {
+		kustomization += "  - " + name + ".yaml\n"
+		manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\ndata:\n  value: (( grab subst." + values[name] + " ))\n"
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".yaml"), []byte(manifest), 0600))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(kustomization), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "subst.yaml"), []byte("value: substituted\n"), 0600))
+	return dir
+}
+
+// configuration to render a test bundle
+func bundleConfig(dir string) config.Configuration {
+	return config.Configuration{
+		RootDirectory: dir,
+		FileRegex:     `subst\.yaml`,
+		EnvRegex:      "^ARGOCD_ENV_",
+		SkipDecrypt:   true,
+	}
+}
+
+func TestParallelBuild(t *testing.T) {
+	values := map[string]string{}
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("cm-%02d", i)
+		names = append(names, name)
+		values[name] = "value"
+	}
+	values["cm-07"] = "missing"
+	values["cm-42"] = "missing"
+
+	ctx := context.Background()
+	b, err := New(ctx, bundleConfig(testBundle(t, values, names...)))
+	assert.NoError(t, err)
+	defer b.Close()
+	assert.NoError(t, b.BuildSubstitutions(ctx))
+
+	// Errors are reported for each failing resource
+	err = b.Build(ctx)
+	assert.ErrorContains(t, err, "ConfigMap /cm-07")
+	assert.ErrorContains(t, err, "ConfigMap /cm-42")
+	assert.Empty(t, b.Manifests)
+
+	// The order of the resources is kept
+	values["cm-07"], values["cm-42"] = "value", "value"
+	b, err = New(ctx, bundleConfig(testBundle(t, values, names...)))
+	assert.NoError(t, err)
+	defer b.Close()
+	assert.NoError(t, b.BuildSubstitutions(ctx))
+	assert.NoError(t, b.Build(ctx))
+	assert.Len(t, b.Manifests, len(names))
+	for i, manifest := range b.Manifests {
+		metadata := manifest["metadata"].(map[interface{}]interface{})
+		assert.Equal(t, names[i], metadata["name"])
+		assert.Equal(t, "substituted", manifest["data"].(map[interface{}]interface{})["value"])
+	}
+}
+
+func TestLocatedErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := testBundle(t, map[string]string{"cm": "missing"}, "cm")
+	b, err := New(ctx, bundleConfig(dir))
+	assert.NoError(t, err)
+	defer b.Close()
+	assert.NoError(t, b.BuildSubstitutions(ctx))
+
+	var located *utils.SourceError
+	err = b.Build(ctx)
+	assert.True(t, errors.As(err, &located))
+	assert.Equal(t, filepath.Join(dir, "cm.yaml"), located.File)
+	assert.Equal(t, 6, located.Line)
+	assert.Equal(t, "ConfigMap /cm", located.Resource)
+	assert.Equal(t, "$.data.value", located.Path)
+
+	// Substitution files
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "subst.yaml"), []byte("value: substituted\nother: (( grab missing ))\n"), 0600))
+	b, err = New(ctx, bundleConfig(dir))
+	assert.NoError(t, err)
+	defer b.Close()
+	err = b.BuildSubstitutions(ctx)
+	assert.True(t, errors.As(err, &located))
+	assert.Equal(t, filepath.Join(dir, "subst.yaml"), located.File)
+	assert.Equal(t, 2, located.Line)
+	assert.Equal(t, "$.other", located.Path)
+}
+
+// Full build of a bundle with the given amount of manifests
+func BenchmarkBuild(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	for _, size := range []int{10, 500} {
+		values := map[string]string{}
+		var names []string
+		for i := 0; i < size; i++ {
+			name := fmt.Sprintf("cm-%04d", i)
+			names = append(names, name)
+			values[name] = "value"
+		}
+		dir := testBundle(b, values, names...)
+
+		b.Run(fmt.Sprintf("manifests=%d", size), func(b *testing.B) {
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				build, err := New(ctx, bundleConfig(dir))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = build.BuildSubstitutions(ctx); err != nil {
+					b.Fatal(err)
+				}
+				if err = build.Build(ctx); err != nil {
+					b.Fatal(err)
+				}
+				build.Close()
+			}
+		})
+	}
+}
+
+// Evaluation of the manifests with a single and with all CPUs, manifests
+// without stateful spruce operators are evaluated in parallel
+func BenchmarkParallelBuild(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+	defer goruntime.GOMAXPROCS(goruntime.GOMAXPROCS(0))
+
+	values := map[string]string{}
+	var names []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("cm-%04d", i)
+		names = append(names, name)
+		values[name] = "value"
+	}
+	dir := testBundle(b, values, names...)
+
+	for _, procs := range []int{1, goruntime.NumCPU()} {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			goruntime.GOMAXPROCS(procs)
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				build, err := New(ctx, bundleConfig(dir))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = build.BuildSubstitutions(ctx); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err = build.Build(ctx); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				build.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	ctx := context.Background()
+	dir := testBundle(t, map[string]string{"cm": "value"}, "cm")
+	cfg := bundleConfig(dir)
+	cfg.SkipDecrypt = false
+	cfg.SecretSkip = true
+	cfg.Decryptors = []string{"ejson"}
+	cfg.EjsonKey = []string{"65b2f2060e6e3a976456c5a7cbcca3f15715eb1d9e0fe54174fa7b36aca1f50e"}
+
+	cacheKey := func(cfg config.Configuration) (string, []byte) {
+		b, err := New(ctx, cfg)
+		assert.NoError(t, err)
+		defer b.Close()
+		key, secret, err := b.CacheKey(ctx)
+		assert.NoError(t, err)
+		return key, secret
+	}
+
+	key, secret := cacheKey(cfg)
+	same, sameSecret := cacheKey(cfg)
+	assert.Equal(t, key, same)
+	assert.Equal(t, secret, sameSecret)
+
+	// Environment variables are part of the key
+	cfg.Env = map[string]string{"ARGOCD_ENV_CLUSTER": "cluster-01"}
+	withEnv, _ := cacheKey(cfg)
+	assert.NotEqual(t, key, withEnv)
+
+	// A rotated key changes the key and the secret
+	rotated := cfg
+	rotated.EjsonKey = []string{"2c5e2d1b8ba2e4ae5f3b0cb1b0e4b1a4c74e5f4e9a1b2c3d4e5f60718293a4b5"}
+	withKey, withKeySecret := cacheKey(rotated)
+	assert.NotEqual(t, withEnv, withKey)
+	assert.NotEqual(t, secret, withKeySecret)
+
+	// Changed substitution files change the key
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "subst.yaml"), []byte("value: changed\n"), 0600))
+	changed, _ := cacheKey(cfg)
+	assert.NotEqual(t, withEnv, changed)
+
+	// The validation and its CustomResourceDefinitions are part of the key
+	crds := t.TempDir()
+	validated := cfg
+	validated.Validate = true
+	validated.CRDDirs = []string{crds}
+	withValidation, _ := cacheKey(validated)
+	assert.NotEqual(t, changed, withValidation)
+	assert.NoError(t, os.WriteFile(filepath.Join(crds, "crd.yaml"), []byte("kind: CustomResourceDefinition\n"), 0600))
+	withCRD, _ := cacheKey(validated)
+	assert.NotEqual(t, withValidation, withCRD)
+
+	// The restrictions of sandboxed builds are part of the key
+	sandboxed := cfg
+	sandboxed.Sandbox = dir
+	withSandbox, _ := cacheKey(sandboxed)
+	assert.NotEqual(t, changed, withSandbox)
+	sandboxed.AllowSubstFrom = []string{"configMap:kube-system/*"}
+	withSources, _ := cacheKey(sandboxed)
+	assert.NotEqual(t, withSandbox, withSources)
+	sandboxed.AllowVaultPaths = []string{"secret/data/app"}
+	withVaultPaths, _ := cacheKey(sandboxed)
+	assert.NotEqual(t, withSources, withVaultPaths)
+
+	// Keys found on disk are part of the secret
+	keys := t.TempDir()
+	onDisk := cfg
+	onDisk.EjsonKey = nil
+	onDisk.Decryptors = []string{"ejson=" + keys}
+	_, withoutKeys := cacheKey(onDisk)
+	assert.NoError(t, os.WriteFile(filepath.Join(keys, "2c5e2d1b8ba2e4ae5f3b0cb1b0e4b1a4c74e5f4e9a1b2c3d4e5f60718293a4b5"), []byte("2c5e2d1b8ba2e4ae5f3b0cb1b0e4b1a4c74e5f4e9a1b2c3d4e5f60718293a4b5"), 0600))
+	_, withDiskKeys := cacheKey(onDisk)
+	assert.NotEqual(t, withoutKeys, withDiskKeys)
+
+	// Substitutions from the cluster are not cacheable
+	b, err := New(ctx, cfg)
+	assert.NoError(t, err)
+	defer b.Close()
+	assert.True(t, b.Cacheable())
+	b.cfg.SubstFromConfigMap = []string{"kube-system/facts"}
+	assert.False(t, b.Cacheable())
+
+	// Neither are decryptors with unknown key material
+	exec := cfg
+	exec.EjsonKey = nil
+	exec.Decryptors = []string{"exec=/bin/true"}
+	b, err = New(ctx, exec)
+	assert.NoError(t, err)
+	defer b.Close()
+	_, _, err = b.CacheKey(ctx)
+	assert.NoError(t, err)
+	assert.False(t, b.Cacheable())
+}
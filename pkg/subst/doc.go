@@ -0,0 +1,16 @@
+// Package subst renders kustomizations with substitutions. Substitution files
+// (subst.yaml and ejson files) found in the kustomize paths are decrypted and
+// merged, the manifests of the kustomize build are then evaluated with spruce
+// against the substitutions.
+//
+// Render is the entry point for other tools:
+//
+//	manifests, err := subst.Render(ctx, "clusters/cluster-01",
+//		subst.WithKeys(privateKey),
+//		subst.WithEnv(map[string]string{"ARGOCD_ENV_CLUSTER": "cluster-01"}),
+//		subst.WithWriter(os.Stdout),
+//	)
+//
+// Build gives access to the single steps (kustomize build, substitutions and
+// evaluation), as used by the CLI.
+package subst
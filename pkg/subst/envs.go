@@ -1,12 +1,22 @@
 package subst
 
 import (
-	"os"
 	"regexp"
 	"strings"
+
+	"github.com/bedag/subst/pkg/config"
 )
 
+// GetVariables returns the variables of the process environment, which match
+// the regex (all variables if empty)
 func GetVariables(regex string) (envs map[string]interface{}, err error) {
+	return Variables(config.Environ(), regex)
+}
+
+// Variables returns the variables of the given environment, which match the
+// regex (all variables if empty). The ARGOCD_ENV_ prefix of Argo CD
+// application variables is removed.
+func Variables(environment map[string]string, regex string) (envs map[string]interface{}, err error) {
 	envs = make(map[string]interface{})
 	var r *regexp.Regexp
 
@@ -17,11 +27,7 @@ func GetVariables(regex string) (envs map[string]interface{}, err error) {
 		}
 	}
 
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		key := pair[0]
-		value := pair[1]
-
+	for key, value := range environment {
 		if value != "" {
 			// Verify if regexp matches (Skip no matches)
 			if regex != "" {
@@ -30,12 +36,200 @@ func GetVariables(regex string) (envs map[string]interface{}, err error) {
 				}
 			}
 			// Rewrite ArgoCD Environment Variables
-			argoRegex := regexp.MustCompile("^ARGOCD_ENV_")
-			if argoRegex.MatchString(key) {
-				key = strings.ReplaceAll(key, "ARGOCD_ENV_", "")
-			}
+			key = strings.TrimPrefix(key, "ARGOCD_ENV_")
 			envs[key] = value
 		}
 	}
 	return envs, nil
 }
+
+// environment variable arguments of spruce operators (eg. "$STAGE")
+var envArgRegex = regexp.MustCompile(`^\$[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// unquoted literals of spruce operators (numbers, booleans and nil)
+var literalArgRegex = regexp.MustCompile(`^([+-]?\d+(\.\d+)?|[+-]?\d*\.\d+|true|True|TRUE|false|False|FALSE|nil|Nil|NIL|null|Null|NULL|~)$`)
+
+// arguments of spruce operators, with and without parentheses (see
+// spruce.ParseOpcall)
+var operatorArgsRegex = []*regexp.Regexp{
+	regexp.MustCompile(`^\(\(\s*[a-zA-Z][a-zA-Z0-9_-]*\s*\((.*)\)\s*\)\)$`),
+	regexp.MustCompile(`^\(\(\s*[a-zA-Z][a-zA-Z0-9_-]*(?:\s+(.*))?\s*\)\)$`),
+}
+
+// reference replacing unset environment variables, spruce fails to resolve
+// it (which allows fallbacks with "||")
+const unsetEnvReference = "environment_variable_not_set"
+
+// bindEnv replaces the environment variables within spruce operators with
+// their values from the configured environment, spruce would otherwise read
+// them from the process environment. Arguments (eg. "(( concat $STAGE ))")
+// are replaced with literals, nodes of references (eg. "subst.$STAGE.name")
+// with the value. Maps and lists are copied if they contain a replacement
+// (reported by the second return value), the given value is never modified.
+func (s *Substitutions) bindEnv(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		var bound map[interface{}]interface{}
+		for key, item := range v {
+			b, changed := s.bindEnv(item)
+			if !changed {
+				continue
+			}
+			if bound == nil {
+				bound = make(map[interface{}]interface{}, len(v))
+				for k, i := range v {
+					bound[k] = i
+				}
+			}
+			bound[key] = b
+		}
+		if bound != nil {
+			return bound, true
+		}
+	case []interface{}:
+		var bound []interface{}
+		for i, item := range v {
+			b, changed := s.bindEnv(item)
+			if !changed {
+				continue
+			}
+			if bound == nil {
+				bound = append([]interface{}{}, v...)
+			}
+			bound[i] = b
+		}
+		if bound != nil {
+			return bound, true
+		}
+	case string:
+		if strings.Contains(v, "$") {
+			if b := mapOperatorArgs(v, s.bindArgEnv); b != v {
+				return b, true
+			}
+		}
+	}
+	return value, false
+}
+
+// replaces the arguments of an operator with the result of f, which is
+// called with each argument as written and as parsed by spruce
+func mapOperatorArgs(op string, f func(raw, arg string) string) string {
+	trimmed := strings.TrimSpace(op)
+	for _, r := range operatorArgsRegex {
+		m := r.FindStringSubmatchIndex(trimmed)
+		if m == nil {
+			continue
+		}
+		if m[2] < 0 {
+			return op
+		}
+		return trimmed[:m[2]] + mapArgs(trimmed[m[2]:m[3]], f) + trimmed[m[3]:]
+	}
+	return op
+}
+
+// splits the arguments like spruce (on spaces, tabs and commas outside of
+// quotes) and replaces them with the result of f
+func mapArgs(args string, f func(raw, arg string) string) string {
+	var out, raw, buf strings.Builder
+	escaped, quoted := false, false
+
+	flush := func() {
+		out.WriteString(f(raw.String(), buf.String()))
+		raw.Reset()
+		buf.Reset()
+	}
+
+	for _, c := range args {
+		if escaped {
+			raw.WriteRune(c)
+			switch c {
+			case 'n':
+				buf.WriteRune('\n')
+			case 'r':
+				buf.WriteRune('\r')
+			case 't':
+				buf.WriteRune('\t')
+			default:
+				buf.WriteRune(c)
+			}
+			escaped = false
+			continue
+		}
+		if c == '\\' {
+			raw.WriteRune(c)
+			escaped = true
+			continue
+		}
+		if (c == ' ' || c == '\t' || c == ',') && !quoted {
+			flush()
+			out.WriteRune(c)
+			continue
+		}
+		if c == '"' {
+			quoted = !quoted
+		}
+		raw.WriteRune(c)
+		buf.WriteRune(c)
+	}
+	flush()
+	return out.String()
+}
+
+// returns the first environment variable (eg. "$STAGE") the argument (as
+// parsed by spruce) reads, either as argument or as node of a reference
+func envArg(arg string) string {
+	if !strings.Contains(arg, "$") || strings.HasPrefix(arg, `"`) {
+		return ""
+	}
+	if envArgRegex.MatchString(arg) {
+		return arg
+	}
+	for _, node := range strings.Split(arg, ".") {
+		if len(node) > 1 && node[0] == '$' {
+			return node
+		}
+	}
+	return ""
+}
+
+// replaces a single argument (raw as written, arg as parsed by spruce)
+func (s *Substitutions) bindArgEnv(raw, arg string) string {
+	if envArg(arg) == "" {
+		return raw
+	}
+
+	if envArgRegex.MatchString(arg) {
+		value := s.Config.Environment[arg[1:]]
+		switch {
+		case value == "":
+			return unsetEnvReference + "." + arg[1:]
+		case literalArgRegex.MatchString(value):
+			return value
+		default:
+			return `"` + escapeArg(value) + `"`
+		}
+	}
+
+	nodes := strings.Split(arg, ".")
+	for i, node := range nodes {
+		if len(node) > 1 && node[0] == '$' {
+			node = s.Config.Environment[node[1:]]
+		}
+		nodes[i] = escapeArg(node)
+	}
+	return strings.Join(nodes, ".")
+}
+
+// escapes the characters spruce splits arguments on
+func escapeArg(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		" ", `\ `,
+		",", `\,`,
+		"\t", `\t`,
+		"\n", `\n`,
+		"\r", `\r`,
+	).Replace(value)
+}
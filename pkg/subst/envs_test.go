@@ -0,0 +1,55 @@
+package subst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBindEnv(t *testing.T) {
+	t.Setenv("STAGE", "process")
+	s := &Substitutions{
+		Config: SubstitutionsConfig{
+			SubstKey: "subst",
+			Environment: map[string]string{
+				"STAGE":    "prod",
+				"REPLICAS": "3",
+				"SPACED":   `a "b", c`,
+			},
+		},
+		Subst: map[interface{}]interface{}{
+			"prod": map[interface{}]interface{}{"name": "production"},
+		},
+	}
+
+	tests := []struct {
+		operator string
+		expected interface{}
+	}{
+		{`(( concat "x-" $STAGE ))`, "x-prod"},
+		{`(( concat("x-", $STAGE) ))`, "x-prod"},
+		{`(( grab $REPLICAS ))`, int64(3)},
+		{`(( concat $SPACED "!" ))`, `a "b", c!`},
+		{`(( grab $MISSING || "default" ))`, "default"},
+		{`(( grab subst.$STAGE.name ))`, "production"},
+		{`(( concat "$STAGE" "-" ))`, "$STAGE-"},
+	}
+	for _, test := range tests {
+		t.Run(test.operator, func(t *testing.T) {
+			manifest := map[interface{}]interface{}{"value": test.operator}
+			eval, err := s.EvalManifest(manifest)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, eval["value"])
+		})
+	}
+
+	// Shared trees are copied
+	shared := map[interface{}]interface{}{"list": []interface{}{"(( grab $STAGE ))"}}
+	bound, changed := s.bindEnv(shared)
+	assert.True(t, changed)
+	assert.Equal(t, map[interface{}]interface{}{"list": []interface{}{`(( grab "prod" ))`}}, bound)
+	assert.Equal(t, "(( grab $STAGE ))", shared["list"].([]interface{})[0])
+
+	_, err := s.EvalManifest(map[interface{}]interface{}{"value": "(( grab $MISSING ))"})
+	assert.ErrorContains(t, err, "environment_variable_not_set.MISSING")
+}
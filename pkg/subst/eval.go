@@ -0,0 +1,94 @@
+package subst
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/wrapper"
+)
+
+// matches references to the substitutions within spruce operators (eg.
+// "subst.cluster.name" or "$.subst.cluster"), the third group contains
+// the top level key. References without a key refer to all substitutions.
+func referenceRegex(substKey string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^\w.-])(\$\.)?` + regexp.QuoteMeta(substKey) + `(\.[^\s.\[\])"',|]+)?`)
+}
+
+// EvalManifest evaluates the spruce operators of a manifest. Instead of
+// merging all substitutions into the manifest, only the substitutions
+// referenced by the operators are copied from the shared tree. Manifests
+// without operators are returned as they are. Environment variables are
+// resolved against the configured environment (see bindEnv).
+func (s *Substitutions) EvalManifest(data map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	operators := findOperators(data, nil)
+	if len(operators) == 0 {
+		return data, nil
+	}
+	if bound, changed := s.bindEnv(data); changed {
+		data = bound.(map[interface{}]interface{})
+		operators = findOperators(data, nil)
+	}
+
+	sub, _ := s.bindEnv(s.referenced(operators))
+	data[s.Config.SubstKey] = sub
+	return wrapper.SpruceEvalOperators(data, []string{s.Config.SubstKey}, operators)
+}
+
+// copies the substitutions referenced by the given operators, the shared
+// tree is never modified by the evaluation of manifests
+func (s *Substitutions) referenced(operators []string) map[interface{}]interface{} {
+	refRegex := s.refRegex
+	if refRegex == nil {
+		refRegex = referenceRegex(s.Config.SubstKey)
+	}
+
+	sub := make(map[interface{}]interface{})
+	for _, op := range operators {
+		for _, match := range refRegex.FindAllStringSubmatch(op, -1) {
+			if match[3] == "" {
+				return utils.DeepCopy(s.Subst).(map[interface{}]interface{})
+			}
+			key, value, found := s.lookup(match[3][1:])
+			if _, done := sub[key]; found && !done {
+				sub[key] = utils.DeepCopy(value)
+			}
+		}
+	}
+	return sub
+}
+
+// top level substitution by its key as written in an operator
+func (s *Substitutions) lookup(key string) (interface{}, interface{}, bool) {
+	if value, ok := s.Subst[key]; ok {
+		return key, value, true
+	}
+	// Keys which are not strings (eg. numbers)
+	for k, value := range s.Subst {
+		if fmt.Sprint(k) == key {
+			return k, value, true
+		}
+	}
+	return nil, nil, false
+}
+
+// collects all spruce operators within the given value (recursive)
+func findOperators(value interface{}, operators []string) []string {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for _, item := range v {
+			operators = findOperators(item, operators)
+		}
+	case []interface{}:
+		for _, item := range v {
+			operators = findOperators(item, operators)
+		}
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if strings.HasPrefix(trimmed, "((") && strings.HasSuffix(trimmed, "))") {
+			operators = append(operators, trimmed)
+		}
+	}
+	return operators
+}
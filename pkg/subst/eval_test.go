@@ -0,0 +1,115 @@
+package subst
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalManifest(t *testing.T) {
+	s := &Substitutions{
+		Config: SubstitutionsConfig{SubstKey: "subst"},
+		Subst: map[interface{}]interface{}{
+			"cluster": map[interface{}]interface{}{"name": "west", "labels": map[interface{}]interface{}{"region": "eu"}},
+			"stage":   "prod",
+			"unused":  "value",
+		},
+	}
+
+	manifest := map[interface{}]interface{}{
+		"metadata": map[interface{}]interface{}{
+			"name": `(( concat subst.cluster.name "-" $.subst.stage ))`,
+			"labels": map[interface{}]interface{}{
+				"team":   "platform",
+				"inject": "(( inject subst.cluster.labels ))",
+			},
+		},
+	}
+	assert.ElementsMatch(t, []interface{}{"cluster", "stage"}, keys(s.referenced(findOperators(manifest, nil))))
+
+	eval, err := s.EvalManifest(manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{
+		"metadata": map[interface{}]interface{}{
+			"name":   "west-prod",
+			"labels": map[interface{}]interface{}{"team": "platform", "region": "eu"},
+		},
+	}, eval)
+
+	// The shared tree is not modified
+	assert.Equal(t, map[interface{}]interface{}{"region": "eu"}, s.Subst["cluster"].(map[interface{}]interface{})["labels"])
+
+	// References to the entire tree
+	assert.Len(t, s.referenced([]string{"(( grab subst ))"}), 3)
+	assert.Empty(t, s.referenced([]string{"(( grab metadata.subst.stage ))", "(( grab mysubst.stage ))"}))
+
+	// Stateful operators are evaluated by spruce itself
+	eval, err = s.EvalManifest(map[interface{}]interface{}{
+		"kind":  "ConfigMap",
+		"stage": "(( grab subst.stage ))",
+		"tmp":   "(( prune ))",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"kind": "ConfigMap", "stage": "prod"}, eval)
+
+	// Manifests without operators are not evaluated
+	plain := map[interface{}]interface{}{"kind": "ConfigMap"}
+	eval, err = s.EvalManifest(plain)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%p", plain), fmt.Sprintf("%p", eval))
+	assert.NotContains(t, eval, "subst")
+}
+
+func keys(m map[interface{}]interface{}) (out []interface{}) {
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
+// substitutions with the given amount of top level keys, each with a nested map
+func benchmarkSubstitutions(size int) *Substitutions {
+	s := &Substitutions{Config: SubstitutionsConfig{SubstKey: "subst"}, Subst: map[interface{}]interface{}{}}
+	for i := 0; i < size; i++ {
+		s.Subst[fmt.Sprintf("key%d", i)] = map[interface{}]interface{}{"name": fmt.Sprintf("value%d", i), "enabled": true}
+	}
+	s.refRegex = referenceRegex(s.Config.SubstKey)
+	return s
+}
+
+func benchmarkManifest() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[interface{}]interface{}{"name": "(( grab subst.key1.name ))"},
+		"data":       map[interface{}]interface{}{"value": "(( concat subst.key2.name \"-\" subst.key3.name ))"},
+	}
+}
+
+func BenchmarkEvalManifest(b *testing.B) {
+	for _, size := range []int{10, 1000} {
+		s := benchmarkSubstitutions(size)
+		b.Run(fmt.Sprintf("substitutions=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.EvalManifest(benchmarkManifest()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Merges all substitutions into the manifest (used for substitution files)
+func BenchmarkEval(b *testing.B) {
+	for _, size := range []int{10, 1000} {
+		s := benchmarkSubstitutions(size)
+		b.Run(fmt.Sprintf("substitutions=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Eval(benchmarkManifest(), nil, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
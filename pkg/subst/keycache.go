@@ -0,0 +1,100 @@
+package subst
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	decrypt "github.com/bedag/subst/internal/decryptors"
+)
+
+// KeyCache keeps the decryption keys read from Kubernetes Secrets for a
+// limited time, so repeated renders of an application (eg. by a long-running
+// server) don't read its Secrets again. Entries are keyed by the Secret, the
+// cache must only be shared by renders using the same cluster.
+type KeyCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]keyCacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+type keyCacheEntry struct {
+	keys    []decrypt.Key
+	expires time.Time
+}
+
+// NewKeyCache creates a cache, which keeps keys for the given duration
+func NewKeyCache(ttl time.Duration) *KeyCache {
+	return &KeyCache{
+		ttl:     ttl,
+		entries: make(map[string]keyCacheEntry),
+	}
+}
+
+// Stats returns the amount of lookups served from the cache and from the
+// cluster
+func (c *KeyCache) Stats() (hits uint64, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Purge removes all entries and zeroes their keys
+func (c *KeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.entries {
+		zeroKeys(entry.keys)
+		delete(c.entries, id)
+	}
+}
+
+// returns a copy of the cached keys of the source, keys are read from the
+// source if they are not cached or expired. Failed lookups are not cached.
+func (c *KeyCache) keys(ctx context.Context, source decrypt.KeySource) ([]decrypt.Key, error) {
+	id := source.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[id]; ok && now.Before(entry.expires) {
+		c.hits++
+		keys := copyKeys(entry.keys)
+		c.mu.Unlock()
+		return keys, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	keys, err := source.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for other, entry := range c.entries {
+		if other == id || !now.Before(entry.expires) {
+			zeroKeys(entry.keys)
+			delete(c.entries, other)
+		}
+	}
+	c.entries[id] = keyCacheEntry{keys: copyKeys(keys), expires: now.Add(c.ttl)}
+	return keys, nil
+}
+
+func copyKeys(keys []decrypt.Key) []decrypt.Key {
+	out := make([]decrypt.Key, len(keys))
+	for i, key := range keys {
+		out[i] = key
+		out[i].Value = append([]byte(nil), key.Value...)
+	}
+	return out
+}
+
+func zeroKeys(keys []decrypt.Key) {
+	for _, key := range keys {
+		decrypt.Zero(key.Value)
+	}
+}
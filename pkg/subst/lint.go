@@ -0,0 +1,418 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	decrypt "github.com/bedag/subst/internal/decryptors"
+	ejson "github.com/bedag/subst/internal/decryptors/ejson"
+	"github.com/bedag/subst/internal/utils"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// Lint rules
+const (
+	// substitution file which can't be parsed (as YAML, JSON or template)
+	RuleParseError = "parse-error"
+	// entry of resources without apiVersion or kind
+	RuleInvalidResource = "invalid-resource"
+	// unencrypted value within an ejson file
+	RuleEjsonPlaintext = "ejson-plaintext"
+	// ejson file encrypted for a public key without loaded private key
+	RuleEjsonMissingKey = "ejson-missing-private-key"
+	// reference to a substitution which does not exist
+	RuleUndefinedKey = "undefined-key"
+	// substitution which is not referenced by any manifest or substitution
+	RuleUnusedKey = "unused-key"
+	// substitutions which could not be built
+	RuleSubstitutions = "substitutions"
+)
+
+// Severities of findings, only errors fail the lint
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// matches the values of templates referenced by a template action (eg.
+// {{ .settings.cluster }}), "$" and "." refer to all values
+var templateRefRegex = regexp.MustCompile(`(^|[\s(|])(\$|\.)([\w-]*)`)
+var templateActionRegex = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+// Finding is a problem found by Lint
+type Finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Resource string `json:"resource,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (f Finding) String() string {
+	e := utils.SourceError{File: f.File, Line: f.Line, Column: f.Column, Resource: f.Resource, Path: f.Path, Message: f.Message}
+	return fmt.Sprintf("%s: %s (%s)", f.Severity, e.Error(), f.Rule)
+}
+
+// substitution keys defined by a file
+type lintKey struct {
+	file *utils.File
+	key  string
+}
+
+type linter struct {
+	b          *Build
+	decryptors []decrypt.Decryptor
+	findings   []Finding
+	// top level keys defined by the substitution files
+	defined []lintKey
+	// top level keys referenced by operators and templates
+	used map[string]bool
+	// set if all substitutions are referenced (eg. grab subst)
+	usedAll bool
+	// files with findings
+	failed map[string]bool
+	// matches references to the substitutions with their path
+	refRegex *regexp.Regexp
+}
+
+// Lint checks the substitution files of the kustomization paths and the
+// references of the manifests to the substitutions. Errors of the lint
+// itself (eg. failed key lookups with --require-secret) are returned.
+func (b *Build) Lint(ctx context.Context) ([]Finding, error) {
+	decryptors, err := b.decryptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fileRegex, err := regexp.Compile(b.cfg.FileRegex)
+	if err != nil {
+		return nil, err
+	}
+	l := &linter{b: b, decryptors: decryptors, used: make(map[string]bool), failed: make(map[string]bool), refRegex: pathReferenceRegex("subst")}
+
+	err = b.Kustomization.Walk(func(path string, f fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.IsDir() || f.Name() == SchemaFile || !fileRegex.MatchString(f.Name()) {
+			return nil
+		}
+		file, err := utils.NewFile(filepath.Join(path, f.Name()))
+		if err != nil {
+			return err
+		}
+		l.file(file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// References and unused keys are only checked against complete
+	// substitutions, keys are not known to be unused if the build failed
+	if err := b.BuildSubstitutions(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		for _, e := range utils.ErrorList(err) {
+			if !l.failed[e.File] {
+				l.add(RuleSubstitutions, SeverityError, e)
+			}
+		}
+	} else {
+		l.references()
+		l.unused()
+	}
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		a, b := l.findings[i], l.findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.findings, nil
+}
+
+func (l *linter) add(rule string, severity string, e *utils.SourceError) {
+	l.findings = append(l.findings, Finding{
+		Rule:     rule,
+		Severity: severity,
+		File:     e.File,
+		Line:     e.Line,
+		Column:   e.Column,
+		Resource: e.Resource,
+		Path:     e.Path,
+		Message:  e.Message,
+	})
+	if severity == SeverityError && e.File != "" {
+		l.failed[e.File] = true
+	}
+}
+
+// adds a finding located within the file
+func (l *linter) addFile(rule string, severity string, file *utils.File, path string, message string) {
+	e := &utils.SourceError{File: file.Path, Path: path, Message: message}
+	e.Locate(file.Byte())
+	l.add(rule, severity, e)
+}
+
+// checks a single substitution file
+func (l *linter) file(file *utils.File) {
+	l.b.log.Debug().Msgf("linting %s", file.Path)
+	var content map[interface{}]interface{}
+	encrypted, err := l.encrypted(file)
+	if err != nil {
+		for _, e := range utils.ErrorList(err) {
+			e.File = file.Path
+			l.add(RuleParseError, SeverityError, e)
+		}
+		return
+	}
+	if encrypted != nil {
+		content = utils.ToInterfaceDeep(encrypted)
+		l.ejson(file, encrypted)
+	} else if content, err = l.parse(file); err != nil {
+		for _, e := range utils.ErrorList(err) {
+			e.File = file.Path
+			l.add(RuleParseError, SeverityError, e)
+		}
+		return
+	}
+
+	if resources, ok := content[resourcesField].([]interface{}); ok {
+		for i, item := range resources {
+			r, _ := item.(map[interface{}]interface{})
+			if r["apiVersion"] == nil || r["kind"] == nil {
+				l.addFile(RuleInvalidResource, SeverityError, file, fmt.Sprintf("$.%s.%d", resourcesField, i), "resource without apiVersion or kind")
+			}
+		}
+	}
+
+	for key := range content {
+		k := fmt.Sprint(key)
+		if k == resourcesField || k == sourcesField || k == ejson.PublicKeyField {
+			continue
+		}
+		// The keys of the vault block are added as substitutions
+		if block, ok := content[key].(map[interface{}]interface{}); ok && k == vaultField {
+			for name := range block {
+				l.defined = append(l.defined, lintKey{file: file, key: fmt.Sprint(name)})
+			}
+			continue
+		}
+		l.defined = append(l.defined, lintKey{file: file, key: k})
+	}
+	for _, op := range findOperators(content, nil) {
+		l.reference(op)
+	}
+	if bytes.Contains(file.Byte(), []byte("{{")) {
+		for _, action := range templateActionRegex.FindAllStringSubmatch(string(file.Byte()), -1) {
+			for _, match := range templateRefRegex.FindAllStringSubmatch(action[1], -1) {
+				if match[3] == "" {
+					l.usedAll = true
+				} else {
+					l.used[match[3]] = true
+				}
+			}
+		}
+	}
+}
+
+// returns the content of files encrypted for one of the decryptors (nil if
+// not encrypted). Missing private keys are reported.
+func (l *linter) encrypted(file *utils.File) (map[string]interface{}, error) {
+	for _, d := range l.decryptors {
+		isEncrypted, err := d.IsEncrypted(file.Byte())
+		if err != nil || !isEncrypted {
+			continue
+		}
+		content, err := decrypt.UnmarshalJSONorYAML(file.Byte())
+		if err != nil {
+			return nil, err
+		}
+		if l.b.cfg.SkipDecrypt {
+			return content, nil
+		}
+		if _, err := d.Decrypt(file.Byte()); err != nil {
+			var missing *decrypt.MissingKeyError
+			if errors.As(err, &missing) {
+				l.addFile(RuleEjsonMissingKey, SeverityError, file, "", withKeyLookups(err, l.b.keyLookups).Error())
+			} else {
+				l.addFile(RuleParseError, SeverityError, file, "", fmt.Sprintf("failed to decrypt: %s", err))
+			}
+		}
+		return content, nil
+	}
+	// ejson files without public key are not encrypted at all
+	if filepath.Ext(file.Path) == ".ejson" {
+		return decrypt.UnmarshalJSONorYAML(file.Byte())
+	}
+	return nil, nil
+}
+
+// parses the file as YAML or template (rendered without values)
+func (l *linter) parse(file *utils.File) (map[interface{}]interface{}, error) {
+	content, err := file.SPRUCE()
+	if err == nil {
+		return content, nil
+	}
+	if !bytes.Contains(file.Byte(), []byte("{{")) {
+		return nil, err
+	}
+	return utils.Template(file.Byte(), nil, nil)
+}
+
+// reports unencrypted values of an ejson file, keys with a leading
+// underscore are not encrypted by ejson
+func (l *linter) ejson(file *utils.File, content map[string]interface{}) {
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				if !strings.HasPrefix(k, "_") {
+					walk(path+"."+k, item)
+				}
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(path+"."+strconv.Itoa(i), item)
+			}
+		case string:
+			if !strings.HasPrefix(v, "EJ[") {
+				l.addFile(RuleEjsonPlaintext, SeverityError, file, path, "value is not encrypted")
+			}
+		}
+	}
+	walk("$", content)
+}
+
+// like referenceRegex, the third group contains the whole path (eg.
+// .cluster.name)
+func pathReferenceRegex(substKey string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[^\w.-])(\$\.)?` + regexp.QuoteMeta(substKey) + `((?:\.[^\s.\[\])"',|]+)*)`)
+}
+
+// marks the top level keys referenced by the operator as used
+func (l *linter) reference(op string) {
+	for _, match := range l.refRegex.FindAllStringSubmatch(op, -1) {
+		if match[3] == "" {
+			l.usedAll = true
+			continue
+		}
+		key, _, _ := strings.Cut(match[3][1:], ".")
+		l.used[key] = true
+	}
+}
+
+// checks the references of the manifests against the substitutions
+func (l *linter) references() {
+	for _, r := range l.b.Substitutions.Resources.Resources() {
+		m, err := r.Map()
+		if err != nil {
+			continue
+		}
+		for _, op := range findOperatorPaths("$", utils.ToInterfaceDeep(m), nil) {
+			l.reference(op.operator)
+			for _, match := range l.refRegex.FindAllStringSubmatch(op.operator, -1) {
+				if match[3] == "" || lookupPath(l.b.Substitutions.Subst, match[3][1:]) {
+					continue
+				}
+				l.undefined(r, op.path, match[0][len(match[1]):])
+			}
+		}
+	}
+}
+
+func (l *linter) undefined(r *resource.Resource, path string, ref string) {
+	err := &utils.SourceError{Path: path, Message: fmt.Sprintf("reference to undefined substitution %s", ref)}
+	l.add(RuleUndefinedKey, SeverityError, utils.ErrorList(l.b.locateManifestError(err, resourceID(r), r))[0])
+}
+
+// reports keys of substitution files which are never referenced
+func (l *linter) unused() {
+	if l.usedAll {
+		return
+	}
+	for _, d := range l.defined {
+		if !l.used[d.key] {
+			l.addFile(RuleUnusedKey, SeverityWarning, d.file, "$."+d.key, fmt.Sprintf("substitution %s is never referenced", d.key))
+		}
+	}
+}
+
+// spruce operator and its path within the manifest
+type operatorPath struct {
+	path     string
+	operator string
+}
+
+// collects all spruce operators with their path (recursive)
+func findOperatorPaths(path string, value interface{}, operators []operatorPath) []operatorPath {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			operators = findOperatorPaths(path+"."+fmt.Sprint(k), item, operators)
+		}
+	case []interface{}:
+		for i, item := range v {
+			operators = findOperatorPaths(path+"."+strconv.Itoa(i), item, operators)
+		}
+	case string:
+		for _, op := range findOperators(v, nil) {
+			operators = append(operators, operatorPath{path: path, operator: op})
+		}
+	}
+	return operators
+}
+
+// reports if the dotted path (eg. settings.cluster.name) exists within the
+// substitutions. List entries are addressed by index or by name.
+func lookupPath(subst map[interface{}]interface{}, path string) bool {
+	var value interface{} = subst
+	for _, segment := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			found := false
+			for k, item := range v {
+				if fmt.Sprint(k) == segment {
+					value, found = item, true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case []interface{}:
+			found := false
+			if i, err := strconv.Atoi(segment); err == nil && i >= 0 && i < len(v) {
+				value, found = v[i], true
+			}
+			for _, item := range v {
+				if m, ok := item.(map[interface{}]interface{}); ok && !found && fmt.Sprint(m["name"]) == segment {
+					value, found = item, true
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
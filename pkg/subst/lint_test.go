@@ -0,0 +1,77 @@
+package subst
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lintFindings(t *testing.T, dir string, files map[string]string, configure func(b *Build)) []string {
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	b, err := New(context.Background(), bundleConfig(dir))
+	assert.NoError(t, err)
+	defer b.Close()
+	if configure != nil {
+		configure(b)
+	}
+	findings, err := b.Lint(context.Background())
+	assert.NoError(t, err)
+
+	var out []string
+	for _, f := range findings {
+		out = append(out, filepath.Base(f.File)+" "+f.Severity+" "+f.Rule+" "+f.Path)
+	}
+	return out
+}
+
+func TestLint(t *testing.T) {
+	findings := lintFindings(t, t.TempDir(), map[string]string{
+		"kustomization.yaml": "resources:\n  - cm.yaml\n",
+		"cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+data:
+  name: (( grab subst.settings.name ))
+  missing: (( grab subst.settings.missing ))
+`,
+		"subst.yaml": `settings:
+  name: cluster-01
+unused: value
+resources:
+  - metdata:
+      name: test
+`,
+	}, nil)
+	assert.ElementsMatch(t, []string{
+		"cm.yaml error undefined-key $.data.missing",
+		"subst.yaml warning unused-key $.unused",
+		"subst.yaml error invalid-resource $.resources.0",
+	}, findings)
+}
+
+func TestLintFiles(t *testing.T) {
+	findings := lintFindings(t, t.TempDir(), map[string]string{
+		"kustomization.yaml": "resources: []\n",
+		"subst.yaml":         "settings: [\n",
+		"secrets.ejson":      `{"_public_key": "795c5bfb2a2dd2e6e3d9b3c4ba6ed3f4ae9787a7b5ff3b1b1c6d3a4b3b6d4c11", "_comment": "plain", "password": "EJ[1:value]", "user": "admin"}`,
+		"plain.ejson":        `{"password": "secret"}`,
+	}, func(b *Build) {
+		b.cfg.FileRegex = `(subst\.yaml|.*\.ejson)`
+		b.cfg.SkipDecrypt = false
+		b.cfg.SecretSkip = true
+		b.cfg.Decryptors = []string{"ejson"}
+	})
+	// The substitutions can not be built, keys are not reported as unused
+	assert.ElementsMatch(t, []string{
+		"subst.yaml error parse-error ",
+		"secrets.ejson error ejson-missing-private-key ",
+		"secrets.ejson error ejson-plaintext $.user",
+		"plain.ejson error ejson-plaintext $.password",
+	}, findings)
+}
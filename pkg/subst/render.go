@@ -0,0 +1,202 @@
+package subst
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bedag/subst/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Option configures a render, see Render and New
+type Option func(*options)
+
+type options struct {
+	cfg        config.Configuration
+	writer     io.Writer
+	kubeClient kubernetes.Interface
+	keyCache   *KeyCache
+	logger     zerolog.Logger
+}
+
+func newOptions(cfg config.Configuration, opts []Option) *options {
+	o := &options{cfg: cfg, logger: log.Logger}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// DefaultConfiguration returns the configuration used by Render. Decryption
+// keys are not read from Kubernetes and no environment variables are exposed,
+// unless configured with options.
+func DefaultConfiguration() config.Configuration {
+	return config.Configuration{
+		EnvRegex:            "^ARGOCD_ENV_.*$",
+		FileRegex:           `(subst\.yaml|.*(ejson))`,
+		SecretSkip:          true,
+		Decryptors:          []string{"ejson"},
+		KubectlTimeout:      30 * time.Second,
+		Output:              "yaml",
+		SubstFromPrecedence: PrecedenceLow,
+		Env:                 map[string]string{},
+	}
+}
+
+// WithConfiguration replaces the configuration, eg. to render with the same
+// configuration as the CLI. Options given after it are applied on top.
+func WithConfiguration(cfg config.Configuration) Option {
+	return func(o *options) {
+		o.cfg = cfg
+	}
+}
+
+// WithKeys adds private keys for the decryption (eg. ejson private keys)
+func WithKeys(keys ...string) Option {
+	return func(o *options) {
+		o.cfg.EjsonKey = append(o.cfg.EjsonKey, keys...)
+	}
+}
+
+// WithKeySources adds sources for decryption keys, one of: file:<path>,
+// env:<variable>, exec:<command>
+func WithKeySources(sources ...string) Option {
+	return func(o *options) {
+		o.cfg.KeySources = append(o.cfg.KeySources, sources...)
+	}
+}
+
+// WithSecret reads decryption keys from the Secret (each key within the
+// Secret is used as a decryption key)
+func WithSecret(namespace string, name string) Option {
+	return func(o *options) {
+		o.cfg.SecretSkip = false
+		o.cfg.Secrets = append(o.cfg.Secrets, namespace+"/"+name)
+	}
+}
+
+// WithKubeClient sets the client used to read Secrets and ConfigMaps, by
+// default a client is created from the kubeconfig
+func WithKubeClient(client kubernetes.Interface) Option {
+	return func(o *options) {
+		o.kubeClient = client
+	}
+}
+
+// WithKeyCache keeps the keys read from Kubernetes Secrets in the cache, it
+// may be shared by renders of the same cluster
+func WithKeyCache(cache *KeyCache) Option {
+	return func(o *options) {
+		o.keyCache = cache
+	}
+}
+
+// WithDecryptors sets the decryptor backends, in the order they are probed.
+// Format: <name>[=<argument>] (eg. ejson, exec=<command>)
+func WithDecryptors(decryptors ...string) Option {
+	return func(o *options) {
+		o.cfg.Decryptors = decryptors
+	}
+}
+
+// WithoutDecryption skips the decryption, encrypted files are loaded without
+// their encryption properties
+func WithoutDecryption() Option {
+	return func(o *options) {
+		o.cfg.SkipDecrypt = true
+	}
+}
+
+// WithEnv sets the environment of the render. Variables are exposed to the
+// substitutions, filtered by the env regex (see WithEnvRegex). The variables
+// are also used for env key sources and Vault credentials.
+func WithEnv(env map[string]string) Option {
+	return func(o *options) {
+		o.cfg.Env = env
+	}
+}
+
+// WithEnvRegex only exposes environment variables matching the regex (all
+// variables if empty)
+func WithEnvRegex(regex string) Option {
+	return func(o *options) {
+		o.cfg.EnvRegex = regex
+	}
+}
+
+// WithSandbox confines the render to the directory of untrusted inputs (eg.
+// an uploaded archive): kustomize only loads files within it and builtin
+// plugins, substitution files may only read the ConfigMaps, Secrets and
+// Vault paths allowed by the configuration (AllowSubstFrom, AllowVaultPaths)
+func WithSandbox(dir string) Option {
+	return func(o *options) {
+		o.cfg.Sandbox = dir
+	}
+}
+
+// WithWriter writes the rendered manifests to w (only used by Render)
+func WithWriter(w io.Writer) Option {
+	return func(o *options) {
+		o.writer = w
+	}
+}
+
+// WithLogger writes the logs of the render to the logger, by default the
+// global logger of zerolog (github.com/rs/zerolog/log) is used
+func WithLogger(logger zerolog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithOutput sets the format written to the writer, one of: yaml, json
+func WithOutput(format string) Option {
+	return func(o *options) {
+		o.cfg.Output = format
+	}
+}
+
+// Render builds the kustomization in dir and substitutes its manifests. The
+// manifests are returned in the order of the kustomize build and written to
+// the writer (if configured). Renders may run concurrently.
+//
+// Render does not modify global state of the process: it does not read flags
+// or the process environment and logs to the configured logger (see
+// WithLogger). Only state shared by design remains global: the decryptor
+// backends are registered once at init, and spruce keeps the state of the
+// prune, sort, vault, awsparam, awssecret and static_ips operators in
+// package variables (manifests with these operators are evaluated one at a
+// time).
+func Render(ctx context.Context, dir string, opts ...Option) ([]map[interface{}]interface{}, error) {
+	o := newOptions(DefaultConfiguration(), opts)
+	o.cfg.RootDirectory = dir
+	if o.cfg.Output != "" && o.cfg.Output != "yaml" && o.cfg.Output != "json" {
+		return nil, fmt.Errorf("invalid output format %q (supported: yaml, json)", o.cfg.Output)
+	}
+
+	b, err := New(ctx, o.cfg, WithKubeClient(o.kubeClient), WithKeyCache(o.keyCache), WithLogger(o.logger))
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	err = b.BuildSubstitutions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Build(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.writer != nil {
+		if err := b.Write(o.writer); err != nil {
+			return nil, err
+		}
+	}
+	return b.Manifests, nil
+}
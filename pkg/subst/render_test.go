@@ -0,0 +1,98 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	// The process environment is not exposed
+	t.Setenv("ARGOCD_ENV_CLUSTER", "process")
+	dir := testBundle(t, map[string]string{"cm": "CLUSTER"}, "cm")
+
+	var out bytes.Buffer
+	manifests, err := Render(context.Background(), dir,
+		WithEnv(map[string]string{"ARGOCD_ENV_CLUSTER": "cluster-01"}),
+		WithWriter(&out),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+	assert.Equal(t, "cluster-01", manifests[0]["data"].(map[interface{}]interface{})["value"])
+	assert.Equal(t, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: cluster-01\n", out.String())
+
+	out.Reset()
+	_, err = Render(context.Background(), dir,
+		WithEnv(map[string]string{"ARGOCD_ENV_CLUSTER": "cluster-02"}),
+		WithWriter(&out),
+		WithOutput("json"),
+	)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"value": "cluster-02"`)
+
+	_, err = Render(context.Background(), dir, WithOutput("toml"))
+	assert.Error(t, err)
+}
+
+func TestRenderLogger(t *testing.T) {
+	var global, logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&global)
+	defer func() { log.Logger = logger }()
+
+	dir := testBundle(t, map[string]string{"cm": "value"}, "cm")
+	_, err := Render(context.Background(), dir, WithLogger(zerolog.New(&logs)))
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "substitute manifests")
+	assert.Empty(t, global.String())
+}
+
+// Renders within one process must not share state, run with -race
+func TestConcurrentRender(t *testing.T) {
+	// The process environment is not read by operators and templates
+	t.Setenv("ARGOCD_ENV_CLUSTER", "process")
+	dir := testBundle(t, map[string]string{"cm": "value", "env": "CLUSTER"}, "cm", "env")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "values.yaml"), []byte("value: other\ntemplated: {{ env \"ARGOCD_ENV_CLUSTER\" }}\n"), 0600))
+	operators := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: operators\ndata:\n" +
+		"  concat: (( concat \"x-\" $ARGOCD_ENV_CLUSTER ))\n" +
+		"  templated: (( grab subst.templated || \"none\" ))\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "operators.yaml"), []byte(operators), 0600))
+	kustomization, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "kustomization.yaml"), append(kustomization, "  - operators.yaml\n"...), 0600))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cfg := DefaultConfiguration()
+			cfg.FileRegex, cfg.SkipDecrypt = `subst\.yaml`, true
+			cluster := fmt.Sprintf("cluster-%02d", i)
+			value, templated := "substituted", "none"
+			if i%2 == 1 {
+				cfg.FileRegex, value, templated = `values\.yaml`, "other", cluster
+			}
+
+			manifests, err := Render(context.Background(), dir,
+				WithConfiguration(cfg),
+				WithEnv(map[string]string{"ARGOCD_ENV_CLUSTER": cluster}),
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, value, manifests[0]["data"].(map[interface{}]interface{})["value"])
+			assert.Equal(t, cluster, manifests[1]["data"].(map[interface{}]interface{})["value"])
+			assert.Equal(t, map[interface{}]interface{}{"concat": "x-" + cluster, "templated": templated}, manifests[2]["data"])
+		}(i)
+	}
+	wg.Wait()
+}
@@ -2,7 +2,6 @@ package subst
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/bedag/subst/internal/utils"
 	"sigs.k8s.io/kustomize/api/provider"
@@ -19,10 +18,9 @@ var (
 // Add single resource to the Substitution
 func (s *Substitutions) addResource(in map[interface{}]interface{}) (err error) {
 	// Create the resource
-	fmt.Printf("resource: %v\n", in)
 	res, err := defaultResourceFactor.FromMap(utils.ToMap(in))
 	if err != nil {
-		log.Fatalf("Failed to create resource: %v", err)
+		return fmt.Errorf("failed to create resource: %w", err)
 	}
 
 	err = s.Resources.Append(res)
@@ -34,9 +32,12 @@ func (s *Substitutions) addResource(in map[interface{}]interface{}) (err error)
 
 // Adds multiple resources to the Substitution
 func (s *Substitutions) addResources(resources []interface{}) (err error) {
-	for _, v := range resources {
-		fmt.Printf("resource: %v\n", v)
-		err = s.addResource(v.(map[interface{}]interface{}))
+	for i, v := range resources {
+		resource, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("resource %d must be a map", i)
+		}
+		err = s.addResource(resource)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,96 @@
+package subst
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bedag/subst/internal/utils"
+)
+
+// Matches spruce operators which read from outside of the sandbox (files,
+// URLs, Vault or AWS), environment variables are matched by operatorEnv
+var sandboxOperatorRegex = regexp.MustCompile(`\(\(\s*(file|load|vault|awsparam|awssecret)\b`)
+
+// restrictions of sandboxed builds (see WithSandbox), they apply to the
+// substitution files and the manifests
+type sandbox struct {
+	// allowed substFrom sources (<kind>:<namespace>/<name>)
+	sources []string
+	// allowed vault paths
+	vaultPaths []string
+}
+
+// reports if the substFrom source is allowed, the name of the allowed
+// sources may be a glob (eg. configMap:kube-system/*)
+func (s *sandbox) sourceAllowed(ref SourceRef) bool {
+	for _, allow := range s.sources {
+		kind, name, found := strings.Cut(allow, ":")
+		if !found || kind != ref.Kind {
+			continue
+		}
+		if ok, _ := path.Match(name, ref.Namespace+"/"+ref.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reports if the vault reference (<path>[:<key>]) is within an allowed path
+func (s *sandbox) vaultAllowed(ref string) bool {
+	p, _, _ := strings.Cut(strings.TrimPrefix(ref, "/"), ":")
+	p = path.Clean(p)
+	for _, allow := range s.vaultPaths {
+		allow = path.Clean(strings.Trim(allow, "/"))
+		if p == allow || strings.HasPrefix(p, allow+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// returns an error for spruce operators reading from outside of the sandbox,
+// vault references of substitution files allowed by the sandbox are resolved
+// before
+func (s *sandbox) operators(p string, value interface{}) error {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			if err := s.operators(p+"."+fmt.Sprint(k), item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if err := s.operators(p+"."+strconv.Itoa(i), item); err != nil {
+				return err
+			}
+		}
+	case string:
+		if m := sandboxOperatorRegex.FindStringSubmatch(v); m != nil {
+			return &utils.SourceError{Path: p, Message: fmt.Sprintf("operator %s is not allowed in sandboxed builds", m[1])}
+		}
+		if name := operatorEnv(v); name != "" {
+			return &utils.SourceError{Path: p, Message: fmt.Sprintf("environment variable %s is not allowed in sandboxed builds", name)}
+		}
+	}
+	return nil
+}
+
+// returns the first environment variable read by an operator (as argument
+// or as node of a reference), the environment of sandboxed builds includes
+// the environment of the server
+func operatorEnv(op string) (found string) {
+	if !strings.Contains(op, "$") {
+		return ""
+	}
+	mapOperatorArgs(op, func(raw, arg string) string {
+		if found == "" {
+			found = envArg(arg)
+		}
+		return raw
+	})
+	return found
+}
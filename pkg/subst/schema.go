@@ -0,0 +1,162 @@
+package subst
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/validation"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// SchemaFile is the name of the JSON Schema (as YAML or JSON) of the
+// substitutions. Schema files are loaded from all kustomization paths, the
+// substitutions must be valid against each of them.
+const SchemaFile = "subst.schema.yaml"
+
+// adds the schema file, it is validated once the substitutions are loaded
+func (s *Substitutions) addSchema(file *utils.File) error {
+	data, err := file.JSON()
+	if err != nil {
+		return &utils.SourceError{File: file.Path, Message: fmt.Sprintf("invalid schema: %s", err), Err: err}
+	}
+	schema := &spec.Schema{}
+	if err := schema.UnmarshalJSON(data); err != nil {
+		return &utils.SourceError{File: file.Path, Message: fmt.Sprintf("invalid schema: %s", err), Err: err}
+	}
+	s.schemas = append(s.schemas, schemaFile{file: file, schema: validation.Expand(schema)})
+	return nil
+}
+
+type schemaFile struct {
+	file   *utils.File
+	schema *spec.Schema
+}
+
+// validates the evaluated substitutions against the schema files. Violations
+// are located in the substitution file defining the value, or in the schema
+// file (eg. for missing required keys).
+func (s *Substitutions) validate() error {
+	if len(s.schemas) == 0 {
+		return nil
+	}
+	data := jsonValue(s.Subst)
+
+	seen := make(map[string]bool)
+	var errs []error
+	for _, sf := range s.schemas {
+		s.log.Debug().Msgf("validating substitutions against %s", sf.file.Path)
+		result := validate.NewSchemaValidator(sf.schema, nil, "", strfmt.Default).Validate(data)
+		for _, err := range result.Errors {
+			e := validation.SourceError(err)
+			if seen[e.Error()] {
+				continue
+			}
+			seen[e.Error()] = true
+			for i := len(s.files) - 1; i >= 0 && e.File == ""; i-- {
+				e.Locate(s.files[i].Byte())
+				if e.Line > 0 {
+					e.File = s.files[i].Path
+				}
+			}
+			if e.File == "" {
+				e.File = sf.file.Path
+			}
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// converts the substitutions to JSON compatible values
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = jsonValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = jsonValue(item)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// inferred JSON Schema, fields are written in this order
+type inferredSchema struct {
+	Schema     string                     `yaml:"$schema,omitempty"`
+	Type       string                     `yaml:"type,omitempty"`
+	Required   []string                   `yaml:"required,omitempty"`
+	Properties map[string]*inferredSchema `yaml:"properties,omitempty"`
+	Items      *inferredSchema            `yaml:"items,omitempty"`
+}
+
+// infers the schema of the value, keys of objects are required
+func inferSchema(value interface{}) *inferredSchema {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		schema := &inferredSchema{Type: "object", Properties: make(map[string]*inferredSchema, len(v))}
+		for k, item := range v {
+			schema.Required = append(schema.Required, k)
+			schema.Properties[k] = inferSchema(item)
+		}
+		sort.Strings(schema.Required)
+		return schema
+	case []interface{}:
+		schema := &inferredSchema{Type: "array"}
+		if len(v) > 0 {
+			schema.Items = inferSchema(v[0])
+		}
+		return schema
+	case string:
+		return &inferredSchema{Type: "string"}
+	case bool:
+		return &inferredSchema{Type: "boolean"}
+	case int, int64, uint64:
+		return &inferredSchema{Type: "integer"}
+	case float64:
+		return &inferredSchema{Type: "number"}
+	default:
+		// eg. null values
+		return &inferredSchema{}
+	}
+}
+
+// WriteSchema writes a JSON Schema inferred from the loaded substitutions,
+// which may be used as subst.schema.yaml
+func (b *Build) WriteSchema(w io.Writer) error {
+	var subst map[interface{}]interface{}
+	if b.Substitutions != nil {
+		subst = b.Substitutions.Subst
+	}
+	schema := inferSchema(jsonValue(subst))
+	schema.Schema = "http://json-schema.org/draft-04/schema#"
+
+	out, err := kyaml.Marshal(schema)
+	if err != nil {
+		return fmt.Errorf("failed to write schema: %w", err)
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,64 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema(t *testing.T) {
+	dir := testBundle(t, map[string]string{"cm": "value"}, "cm")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "subst.yaml"), []byte("value: substituted\nport: \"80\"\nstage: test\nlist:\n  - name: a\n"), 0600))
+	schema := `type: object
+required: [value, region]
+properties:
+  port:
+    type: integer
+  stage:
+    enum: [dev, prod]
+  list:
+    type: array
+    items:
+      properties:
+        name:
+          pattern: "^[0-9]+$"
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, SchemaFile), []byte(schema), 0600))
+
+	b, err := New(context.Background(), bundleConfig(dir))
+	assert.NoError(t, err)
+	err = b.BuildSubstitutions(context.Background())
+	assert.Error(t, err)
+
+	var paths []string
+	for _, e := range utils.ErrorList(err) {
+		paths = append(paths, e.Path)
+		if e.Path == "$.region" {
+			assert.Equal(t, filepath.Join(dir, SchemaFile), e.File)
+		} else {
+			assert.Equal(t, filepath.Join(dir, "subst.yaml"), e.File)
+			assert.NotZero(t, e.Line, e.Path)
+		}
+	}
+	assert.ElementsMatch(t, []string{"$.list.0.name", "$.port", "$.region", "$.stage"}, paths)
+
+	// The schema is inferred from the substitutions
+	cfg := bundleConfig(dir)
+	cfg.SkipSchema = true
+	b, err = New(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, b.BuildSubstitutions(context.Background()))
+	var out bytes.Buffer
+	assert.NoError(t, b.WriteSchema(&out))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, SchemaFile), out.Bytes(), 0600))
+
+	b, err = New(context.Background(), bundleConfig(dir))
+	assert.NoError(t, err)
+	assert.NoError(t, b.BuildSubstitutions(context.Background()))
+	assert.Contains(t, out.String(), "  list:\n    type: array\n    items:\n      type: object\n")
+}
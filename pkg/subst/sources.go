@@ -0,0 +1,157 @@
+package subst
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bedag/subst/internal/wrapper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	sourcesField = "substFrom"
+
+	SourceConfigMap = "configMap"
+	SourceSecret    = "secret"
+
+	// Source data is added before the substitution files, files may overwrite it
+	PrecedenceLow = "low"
+	// Source data is added after the substitution files and overwrites them
+	PrecedenceHigh = "high"
+)
+
+// Reference to a ConfigMap or Secret, whose data is used as substitutions
+type SourceRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (r SourceRef) String() string {
+	return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// ParseSourceRef parses a reference of the format "<namespace>/<name>"
+func ParseSourceRef(kind string, ref string) (SourceRef, error) {
+	if kind != SourceConfigMap && kind != SourceSecret {
+		return SourceRef{}, fmt.Errorf("unknown source kind %q (supported: %s, %s)", kind, SourceConfigMap, SourceSecret)
+	}
+	namespace, name, found := strings.Cut(ref, "/")
+	if !found || namespace == "" || name == "" {
+		return SourceRef{}, fmt.Errorf("invalid %s reference %q, expected <namespace>/<name>", kind, ref)
+	}
+	return SourceRef{Kind: kind, Namespace: namespace, Name: name}, nil
+}
+
+// reads the references from a `substFrom` block:
+//
+//	substFrom:
+//	  - configMap: kube-system/cluster-facts
+//	  - secret: platform/credentials
+func parseSourceRefs(block interface{}) (refs []SourceRef, err error) {
+	entries, ok := block.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", sourcesField)
+	}
+	for _, entry := range entries {
+		m, ok := entry.(map[interface{}]interface{})
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("%s entries must have exactly one of %s or %s", sourcesField, SourceConfigMap, SourceSecret)
+		}
+		for kind, ref := range m {
+			r, err := ParseSourceRef(fmt.Sprintf("%v", kind), fmt.Sprintf("%v", ref))
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, r)
+		}
+	}
+	return refs, nil
+}
+
+// adds the data of the referenced resource to the substitutions, based on
+// the configured precedence
+func (s *Substitutions) AddSource(ctx context.Context, ref SourceRef) error {
+	return s.addSource(ctx, ref, false)
+}
+
+// adds the data of a source, sources of substFrom blocks (fromFile) with low
+// precedence are merged beneath all substitution files once they are loaded
+func (s *Substitutions) addSource(ctx context.Context, ref SourceRef, fromFile bool) error {
+	if s.kubeClient == nil {
+		return fmt.Errorf("can not read %s, no kubernetes client available", ref)
+	}
+	client, err := s.kubeClient()
+	if err != nil {
+		return fmt.Errorf("can not read %s: %w", ref, err)
+	}
+	ctx, cancel := kubeContext(ctx, s.kubeTimeout)
+	defer cancel()
+	data, err := readSource(ctx, client, ref)
+	if err != nil {
+		return stepError(fmt.Sprintf("reading %s", ref), err)
+	}
+	// The data of Secrets is tracked like decrypted values
+	if ref.Kind == SourceSecret {
+		s.taint(data, ref.String())
+	}
+
+	s.external = true
+	if s.Config.SourcePrecedence == PrecedenceHigh {
+		s.pending = append(s.pending, data)
+		return nil
+	}
+	if fromFile {
+		s.defaults = append(s.defaults, data)
+		return nil
+	}
+	return s.Add(data, true)
+}
+
+// merges the data of substFrom blocks with low precedence beneath the
+// substitutions and the data of sources with high precedence over them
+func (s *Substitutions) applySources() error {
+	if len(s.defaults) > 0 {
+		merge, err := wrapper.SpruceMerge(append(s.defaults, s.Get())...)
+		if err != nil {
+			return fmt.Errorf("could not merge source data with substitutions: %s", err)
+		}
+		s.Subst = merge
+	}
+	s.defaults = nil
+
+	for _, data := range s.pending {
+		merge, err := wrapper.SpruceMerge(s.Get(), data)
+		if err != nil {
+			return fmt.Errorf("could not merge source data with substitutions: %s", err)
+		}
+		s.Subst = merge
+	}
+	s.pending = nil
+	return nil
+}
+
+func readSource(ctx context.Context, client kubernetes.Interface, ref SourceRef) (map[interface{}]interface{}, error) {
+	data := make(map[interface{}]interface{})
+	switch ref.Kind {
+	case SourceConfigMap:
+		cm, err := client.CoreV1().ConfigMaps(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ref, err)
+		}
+		for k, v := range cm.Data {
+			data[k] = v
+		}
+	case SourceSecret:
+		secret, err := client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ref, err)
+		}
+		for k, v := range secret.Data {
+			data[k] = string(v)
+		}
+	}
+	return data, nil
+}
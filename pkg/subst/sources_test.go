@@ -0,0 +1,83 @@
+package subst
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func sourceClient() (kubernetes.Interface, error) {
+	return fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-facts", Namespace: "kube-system"},
+			Data:       map[string]string{"region": "west", "stage": "prod"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "platform"},
+			Data:       map[string][]byte{"password": []byte("s3cr3t")},
+		},
+	), nil
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	cm := SourceRef{Kind: SourceConfigMap, Namespace: "kube-system", Name: "cluster-facts"}
+	file := map[interface{}]interface{}{"stage": "dev"}
+
+	// Low: substitution files overwrite the source
+	s := &Substitutions{Subst: map[interface{}]interface{}{}, Config: SubstitutionsConfig{SourcePrecedence: PrecedenceLow}, kubeClient: sourceClient}
+	assert.NoError(t, s.AddSource(context.Background(), cm))
+	assert.NoError(t, s.Add(file, true))
+	assert.NoError(t, s.applySources())
+	assert.Equal(t, "dev", s.Subst["stage"])
+	assert.Equal(t, "west", s.Subst["region"])
+
+	// High: the source overwrites substitution files
+	s = &Substitutions{Subst: map[interface{}]interface{}{}, Config: SubstitutionsConfig{SourcePrecedence: PrecedenceHigh}, kubeClient: sourceClient}
+	assert.NoError(t, s.AddSource(context.Background(), cm))
+	assert.NoError(t, s.Add(file, true))
+	assert.NoError(t, s.applySources())
+	assert.Equal(t, "prod", s.Subst["stage"])
+
+	assert.NoError(t, s.AddSource(context.Background(), SourceRef{Kind: SourceSecret, Namespace: "platform", Name: "credentials"}))
+	assert.NoError(t, s.applySources())
+	assert.Equal(t, "s3cr3t", s.Subst["password"])
+	source, ok := s.tainted("s3cr3t")
+	assert.True(t, ok)
+	assert.Equal(t, "secret platform/credentials", source)
+	_, ok = s.tainted("west")
+	assert.False(t, ok)
+
+	assert.Error(t, s.AddSource(context.Background(), SourceRef{Kind: SourceSecret, Namespace: "platform", Name: "missing"}))
+
+	// Low: substFrom blocks do not overwrite files loaded before
+	s = &Substitutions{Subst: map[interface{}]interface{}{}, Config: SubstitutionsConfig{SourcePrecedence: PrecedenceLow}, kubeClient: sourceClient}
+	assert.NoError(t, s.Add(file, true))
+	assert.NoError(t, s.addSource(context.Background(), cm, true))
+	assert.NoError(t, s.applySources())
+	assert.Equal(t, "dev", s.Subst["stage"])
+	assert.Equal(t, "west", s.Subst["region"])
+}
+
+func TestParseSourceRefs(t *testing.T) {
+	refs, err := parseSourceRefs([]interface{}{
+		map[interface{}]interface{}{"configMap": "kube-system/cluster-facts"},
+		map[interface{}]interface{}{"secret": "platform/credentials"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []SourceRef{
+		{Kind: SourceConfigMap, Namespace: "kube-system", Name: "cluster-facts"},
+		{Kind: SourceSecret, Namespace: "platform", Name: "credentials"},
+	}, refs)
+
+	_, err = parseSourceRefs([]interface{}{map[interface{}]interface{}{"configMap": "cluster-facts"}})
+	assert.Error(t, err)
+	_, err = parseSourceRefs([]interface{}{map[interface{}]interface{}{"service": "ns/name"}})
+	assert.Error(t, err)
+	_, err = parseSourceRefs(map[interface{}]interface{}{"configMap": "ns/name"})
+	assert.Error(t, err)
+}
@@ -1,23 +1,26 @@
 package subst
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"text/template"
+	"time"
 
-	"github.com/bedag/spruce"
 	decrypt "github.com/bedag/subst/internal/decryptors"
 	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/vault"
 	"github.com/bedag/subst/internal/wrapper"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/kustomize/api/resmap"
-)
-
-var (
-	matchingRegex *regexp.Regexp
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 type Substitutions struct {
@@ -26,6 +29,36 @@ type Substitutions struct {
 	decryptors []decrypt.Decryptor
 	funcmap    template.FuncMap
 	Resources  resmap.ResMap
+	layout     *kyaml.Node
+	vault      *vault.Client
+	kubeClient func() (kubernetes.Interface, error)
+	// source data merged over the substitution files (high precedence)
+	pending []map[interface{}]interface{}
+	// source data of substFrom blocks merged beneath the substitution files
+	// (low precedence)
+	defaults   []map[interface{}]interface{}
+	keyLookups []error
+	// timeout for Kubernetes calls
+	kubeTimeout time.Duration
+	// matches references to the substitutions within operators
+	refRegex *regexp.Regexp
+	// set if substitutions were read from the cluster
+	external bool
+	// loaded substitution files, used to locate errors
+	files []*utils.File
+	// matches the names of substitution files
+	fileRegex *regexp.Regexp
+	// schemas the substitutions are validated against
+	schemas []schemaFile
+	// secret values (decrypted, from Vault or Secrets) and their source
+	secrets map[string]string
+	// set if decryption is skipped, the values are not tainted
+	skipDecrypt bool
+	// key of the placeholders of secret values (see Build.redactKey)
+	redactKey []byte
+	// restrictions of sandboxed substitution files, nil if unrestricted
+	sandbox *sandbox
+	log     zerolog.Logger
 }
 
 type SubstitutionsConfig struct {
@@ -33,6 +66,11 @@ type SubstitutionsConfig struct {
 	EnvironmentRegex string `yaml:"environment_regex"`
 	SubstFileRegex   string `yaml:"subst_file_pattern"`
 	FlattenLowerCase bool   `yaml:"lowercase"`
+	SourcePrecedence string `yaml:"source_precedence"`
+	// Environment variables exposed to the substitutions
+	Environment map[string]string `yaml:"-"`
+	// Logger of the substitutions, the global logger if nil
+	Logger *zerolog.Logger `yaml:"-"`
 }
 
 func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res resmap.ResMap) (s *Substitutions, err error) {
@@ -41,26 +79,41 @@ func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res
 		cfg.SubstKey = "subst"
 	}
 
+	switch cfg.SourcePrecedence {
+	case "":
+		cfg.SourcePrecedence = PrecedenceLow
+	case PrecedenceLow, PrecedenceHigh:
+	default:
+		return nil, fmt.Errorf("invalid source precedence %q (supported: %s, %s)", cfg.SourcePrecedence, PrecedenceLow, PrecedenceHigh)
+	}
+
 	init := &Substitutions{
 		Subst:      make(map[interface{}]interface{}),
 		Config:     cfg,
 		decryptors: decrypts,
 		Resources:  res,
+		refRegex:   referenceRegex(cfg.SubstKey),
+		log:        log.Logger,
+	}
+	if cfg.Logger != nil {
+		init.log = *cfg.Logger
 	}
 
 	if init.Config.SubstFileRegex != "" {
-		matchingRegex, err = regexp.Compile(init.Config.SubstFileRegex)
+		init.fileRegex, err = regexp.Compile(init.Config.SubstFileRegex)
 		if err != nil {
 			return nil, err
 		}
-		log.Debug().Msgf("using regex: %s", init.Config.SubstFileRegex)
+		init.log.Debug().Msgf("using regex: %s", init.Config.SubstFileRegex)
 
 	}
 
-	// Load sprig functionMap
+	// Load sprig functionMap, environment functions read the configured
+	// environment
 	init.funcmap = utils.SprigFuncMap()
+	utils.BindEnvFuncs(init.funcmap, cfg.Environment)
 
-	envs, err := GetVariables(cfg.EnvironmentRegex)
+	envs, err := Variables(cfg.Environment, cfg.EnvironmentRegex)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +130,11 @@ func (s *Substitutions) Get() map[interface{}]interface{} {
 	return s.Subst
 }
 
+// Layout returns the key order of the loaded substitution files
+func (s *Substitutions) Layout() *kyaml.Node {
+	return s.layout
+}
+
 // ToMap returns the Substitutions as map[string]interface{}
 func (s *Substitutions) GetMap() map[string]interface{} {
 	return utils.ToMap(s.Subst)
@@ -87,12 +145,12 @@ func (s *Substitutions) Add(data map[interface{}]interface{}, optimistic bool) (
 
 	tree, err := s.Eval(data, nil, optimistic)
 	if err != nil {
-		return fmt.Errorf("failed to build substitutions: %s", err)
+		return fmt.Errorf("failed to build substitutions: %w", err)
 	}
 
-	merge, err := spruce.Merge(s.Get(), tree)
+	merge, err := wrapper.SpruceMerge(s.Get(), tree)
 	if err != nil {
-		return fmt.Errorf("could not merge manifest with substitutions: %s", err)
+		return fmt.Errorf("could not merge manifest with substitutions: %w", err)
 	}
 
 	s.Subst = merge
@@ -109,9 +167,12 @@ func (s *Substitutions) Eval(data map[interface{}]interface{}, substs map[interf
 		s.Config.SubstKey: substs,
 	}
 
-	merge, err := spruce.Merge(data, sub)
+	merge, err := wrapper.SpruceMerge(data, sub)
 	if err != nil {
-		return nil, fmt.Errorf("could not merge manifest with substitutions: %s", err)
+		return nil, fmt.Errorf("could not merge manifest with substitutions: %w", err)
+	}
+	if bound, changed := s.bindEnv(merge); changed {
+		merge = bound.(map[interface{}]interface{})
 	}
 
 	if optimistic {
@@ -130,68 +191,157 @@ func (s *Substitutions) Eval(data map[interface{}]interface{}, substs map[interf
 	return eval, nil
 }
 
-func (s *Substitutions) Walk(path string, f fs.FileInfo) error {
+func (s *Substitutions) Walk(ctx context.Context, path string, f fs.FileInfo) error {
 
 	if f.IsDir() {
 		return nil
 	}
 	full := filepath.Join(path, f.Name())
+	if err := ctx.Err(); err != nil {
+		return stepError(fmt.Sprintf("loading substitutions from %s", full), err)
+	}
 
-	if matchingRegex.MatchString(f.Name()) {
-		var c map[interface{}]interface{}
-		log.Debug().Msgf("processing: %s", full)
+	if f.Name() == SchemaFile {
+		s.log.Debug().Msgf("loading schema: %s", full)
 		file, err := utils.NewFile(full)
 		if err != nil {
 			return err
 		}
+		return s.addSchema(file)
+	}
 
-		c, err = file.SPRUCE()
+	if s.fileRegex != nil && s.fileRegex.MatchString(f.Name()) {
+		s.log.Debug().Msgf("processing: %s", full)
+		file, err := utils.NewFile(full)
 		if err != nil {
-			if c, err = utils.Template(file.Byte(), s.Subst); err != nil {
-				return fmt.Errorf("failed to template %s: %s", full, err)
+			return err
+		}
+
+		// Errors are located within the file
+		err = s.load(ctx, file)
+		if err != nil {
+			return utils.WithSource(err, func(e *utils.SourceError) {
+				e.File = full
+				e.Locate(file.Byte())
+			})
+		}
+		s.files = append(s.files, file)
+
+		s.log.Debug().Msgf("loaded: %s", full)
+	}
+	return nil
+}
+
+// locates errors of the evaluated substitutions within the loaded files, the
+// last file defining the path has precedence. Errors of the copy below the
+// substitution key are duplicates and dropped.
+func (s *Substitutions) locate(err error) error {
+	duplicate := "$." + s.Config.SubstKey + "."
+	var errs []error
+	for _, e := range utils.ErrorList(err) {
+		if strings.HasPrefix(e.Path, duplicate) {
+			continue
+		}
+		for i := len(s.files) - 1; i >= 0 && e.File == ""; i-- {
+			e.Locate(s.files[i].Byte())
+			if e.Line > 0 {
+				e.File = s.files[i].Path
 			}
 		}
+		errs = append(errs, e)
+	}
+	if len(errs) == 0 {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// adds the substitutions of a single file
+func (s *Substitutions) load(ctx context.Context, file *utils.File) error {
+	c, err := file.SPRUCE()
+	if err != nil {
+		if c, err = utils.Template(file.Byte(), s.Subst, s.funcmap); err != nil {
+			return err
+		}
+	}
 
-		// Read encrypted file
-		for _, d := range s.decryptors {
-			isEncrypted, _ := d.IsEncrypted(file.Byte())
+	// Read encrypted file
+	for _, d := range s.decryptors {
+		isEncrypted, _ := d.IsEncrypted(file.Byte())
+		if isEncrypted {
+			s.log.Debug().Msgf("decrypted: %s", file.Path)
+			dm, err := d.Decrypt(file.Byte())
 			if err != nil {
-				break
+				return fmt.Errorf("failed to decrypt: %w", withKeyLookups(err, s.keyLookups))
 			}
-			if isEncrypted {
-				log.Debug().Msgf("decrypted: %s", full)
-				file.Byte()
-				dm, err := d.Decrypt(file.Byte())
-				if err != nil {
-					return fmt.Errorf("failed to decrypt %s: %s", full, err)
-				}
-				t, err := json.Marshal(dm)
-				if err != nil {
-					return fmt.Errorf("failed to marshal %s: %s", full, err)
-				}
-				c, err = utils.ParseYAML(t)
-				if err != nil {
-					return fmt.Errorf("failed to parse %s: %s", full, err)
-				}
-				break
+			if !s.skipDecrypt {
+				s.taint(dm, file.Path)
+			}
+			t, err := json.Marshal(dm)
+			if err != nil {
+				return fmt.Errorf("failed to marshal: %w", err)
+			}
+			c, err = utils.ParseYAML(t)
+			if err != nil {
+				return fmt.Errorf("failed to parse: %w", err)
 			}
+			break
 		}
+	}
 
-		if c[resourcesField] != nil {
-			log.Debug().Msgf("detected resources in %s", full)
-			err = s.addResources(c[resourcesField].([]interface{}))
+	err = s.resolveVault(ctx, c)
+	if err != nil {
+		return stepError("vault lookup", fmt.Errorf("failed to resolve vault references: %w", err))
+	}
+	if s.sandbox != nil {
+		if err := s.sandbox.operators("$", c); err != nil {
+			return err
+		}
+	}
+
+	if c[sourcesField] != nil {
+		refs, err := parseSourceRefs(c[sourcesField])
+		if err != nil {
+			return &utils.SourceError{Path: "$." + sourcesField, Message: err.Error(), Err: err}
+		}
+		delete(c, sourcesField)
+		for i, ref := range refs {
+			if s.sandbox != nil && !s.sandbox.sourceAllowed(ref) {
+				return &utils.SourceError{
+					Path:    fmt.Sprintf("$.%s.%d", sourcesField, i),
+					Message: fmt.Sprintf("%s is not allowed (see --allow-subst-from)", ref),
+				}
+			}
+			err = s.addSource(ctx, ref, true)
 			if err != nil {
-				return fmt.Errorf("failed to add resources from %s: %s", full, err)
+				return fmt.Errorf("failed to add source: %w", err)
 			}
-			delete(c, resourcesField)
 		}
+	}
 
-		err = s.Add(c, true)
+	if c[resourcesField] != nil {
+		s.log.Debug().Msgf("detected resources in %s", file.Path)
+		resources, ok := c[resourcesField].([]interface{})
+		if !ok {
+			err = fmt.Errorf("%s must be a list", resourcesField)
+		} else {
+			err = s.addResources(resources)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to merge %s: %s", full, err)
+			return &utils.SourceError{Path: "$." + resourcesField, Message: err.Error(), Err: err}
 		}
+		delete(c, resourcesField)
+	}
+
+	err = s.Add(c, true)
+	if err != nil {
+		return fmt.Errorf("failed to merge: %w", err)
+	}
 
-		log.Debug().Msgf("loaded: %s", full)
+	// Key order is only informational, files which can not be parsed as
+	// YAML (eg. templates) are skipped
+	if layout, err := utils.ParseLayout(file.Byte()); err == nil {
+		s.layout = utils.MergeLayout(s.layout, layout)
 	}
 	return nil
 }
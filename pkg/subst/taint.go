@@ -0,0 +1,244 @@
+package subst
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bedag/subst/internal/utils"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// Policies for decrypted values outside of Secrets
+const (
+	// log a warning
+	SecretPolicyWarn = "warn"
+	// fail the build
+	SecretPolicyStrict = "strict"
+)
+
+// secret values shorter than this are only detected and redacted as whole
+// value, as they are likely contained in unrelated values (eg. "true")
+const minSecretLength = 6
+
+// records the secret values of a source (a decrypted file, a Vault reference
+// or a Secret), keys with a leading underscore are not encrypted (eg. ejson
+// _public_key)
+func (s *Substitutions) taint(value interface{}, source string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if !strings.HasPrefix(k, "_") {
+				s.taint(item, source)
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			if !strings.HasPrefix(fmt.Sprint(k), "_") {
+				s.taint(item, source)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			s.taint(item, source)
+		}
+	case string:
+		if v == "" {
+			return
+		}
+		if s.secrets == nil {
+			s.secrets = make(map[string]string)
+		}
+		s.secrets[v] = source
+	}
+}
+
+// returns the source of a secret value within the value
+func (s *Substitutions) tainted(value string) (string, bool) {
+	if source, ok := s.secrets[value]; ok {
+		return source, true
+	}
+	for secret, source := range s.secrets {
+		if len(secret) >= minSecretLength && strings.Contains(value, secret) {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// returns a function replacing the secret values within a string by their
+// placeholder (see utils.RedactWithKey)
+func (s *Substitutions) redactor() func(string) string {
+	// Longer values first, they may contain shorter ones
+	secrets := make([]string, 0, len(s.secrets))
+	for secret := range s.secrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if len(secrets[i]) != len(secrets[j]) {
+			return len(secrets[i]) > len(secrets[j])
+		}
+		return secrets[i] < secrets[j]
+	})
+
+	return func(v string) string {
+		if _, ok := s.secrets[v]; ok {
+			return utils.RedactWithKey(s.redactKey, v)
+		}
+		for _, secret := range secrets {
+			if len(secret) >= minSecretLength {
+				v = strings.ReplaceAll(v, secret, utils.RedactWithKey(s.redactKey, secret))
+			}
+		}
+		return v
+	}
+}
+
+// returns a copy of the value with the secret values replaced by their
+// placeholder
+func (s *Substitutions) redact(value interface{}) interface{} {
+	if len(s.secrets) == 0 {
+		return value
+	}
+	redact := s.redactor()
+
+	var walk func(value interface{}) interface{}
+	walk = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case map[interface{}]interface{}:
+			out := make(map[interface{}]interface{}, len(v))
+			for k, item := range v {
+				out[k] = walk(item)
+			}
+			return out
+		case []interface{}:
+			out := make([]interface{}, len(v))
+			for i, item := range v {
+				out[i] = walk(item)
+			}
+			return out
+		case string:
+			return redact(v)
+		}
+		return value
+	}
+	return walk(value)
+}
+
+// returns the error with the secret values within its messages replaced by
+// their placeholder (eg. validation errors quoting a value). The located
+// errors are copied without their causes, which may contain the values.
+func (s *Substitutions) redactError(err error) error {
+	if err == nil || s == nil || len(s.secrets) == 0 {
+		return err
+	}
+	redact := s.redactor()
+	if redact(err.Error()) == err.Error() {
+		return err
+	}
+	var errs []error
+	for _, e := range utils.ErrorList(err) {
+		c := *e
+		c.Message = redact(e.Message)
+		c.Err = nil
+		errs = append(errs, &c)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// field which may contain decrypted values
+type secretAllow struct {
+	kind string
+	path string
+}
+
+// parses the allowed fields (<kind>:<path>, eg. ConfigMap:$.data.password)
+func parseSecretAllow(entries []string) ([]secretAllow, error) {
+	allow := make([]secretAllow, 0, len(entries))
+	for _, entry := range entries {
+		kind, path, found := strings.Cut(entry, ":")
+		if !found || kind == "" || !strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("invalid secret allow %q, expected <kind>:<path> (eg. ConfigMap:$.data.password)", entry)
+		}
+		allow = append(allow, secretAllow{kind: kind, path: strings.TrimSuffix(path, ".")})
+	}
+	return allow, nil
+}
+
+// reports if the field may contain decrypted values, Secrets may contain them
+// in data and stringData. Allowed paths include their children.
+func secretAllowed(allow []secretAllow, kind string, path string) bool {
+	if kind == "Secret" {
+		allow = append(allow, secretAllow{kind: "Secret", path: "$.data"}, secretAllow{kind: "Secret", path: "$.stringData"})
+	}
+	for _, a := range allow {
+		if (a.kind == "*" || a.kind == kind) && (path == a.path || strings.HasPrefix(path, a.path+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the manifests for secret values outside of Secrets and the allowed
+// fields. They are logged as warnings, or fail the build with the
+// strict policy. The values are never part of the messages.
+func (b *Build) checkSecrets(resources []*resource.Resource) error {
+	switch b.cfg.SecretPolicy {
+	case "", SecretPolicyWarn, SecretPolicyStrict:
+	default:
+		return fmt.Errorf("invalid secret policy %q (supported: %s, %s)", b.cfg.SecretPolicy, SecretPolicyWarn, SecretPolicyStrict)
+	}
+	allow, err := parseSecretAllow(b.cfg.SecretAllow)
+	if err != nil {
+		return err
+	}
+	if len(b.Substitutions.secrets) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for i, manifest := range b.Manifests {
+		var leaks []error
+		kind := fmt.Sprint(manifest["kind"])
+		var walk func(path string, value interface{})
+		walk = func(path string, value interface{}) {
+			switch v := value.(type) {
+			case map[interface{}]interface{}:
+				for k, item := range v {
+					walk(path+"."+fmt.Sprint(k), item)
+				}
+			case []interface{}:
+				for j, item := range v {
+					walk(path+"."+strconv.Itoa(j), item)
+				}
+			case string:
+				if secretAllowed(allow, kind, path) {
+					return
+				}
+				if file, ok := b.Substitutions.tainted(v); ok {
+					err := &utils.SourceError{Path: path, Message: fmt.Sprintf("contains a secret value from %s outside of a Secret (see --secret-allow)", file)}
+					leaks = append(leaks, b.locateManifestError(err, resourceID(resources[i]), resources[i]))
+				}
+			}
+		}
+		walk("$", manifest)
+		// Map order is not stable
+		sort.Slice(leaks, func(i, j int) bool { return leaks[i].Error() < leaks[j].Error() })
+		errs = append(errs, leaks...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if b.cfg.SecretPolicy == SecretPolicyStrict {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		b.log.Warn().Msg(err.Error())
+	}
+	return nil
+}
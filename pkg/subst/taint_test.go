@@ -0,0 +1,195 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// kustomization with the testdata ejson file, the decrypted password is
+// grabbed into a ConfigMap, a Secret and container args
+func secretBundle(t *testing.T) string {
+	dir := t.TempDir()
+	encrypted, err := os.ReadFile("../../internal/decryptors/ejson/testdata/encrypted.ejson")
+	assert.NoError(t, err)
+	files := map[string]string{
+		"secrets.ejson":      string(encrypted),
+		"subst.yaml":         "user: admin\n",
+		"kustomization.yaml": "resources:\n  - app.yaml\n",
+		"app.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+data:
+  user: (( grab subst.user ))
+  password: (( grab subst.data.database_password ))
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: secret
+stringData:
+  password: (( grab subst.data.database_password ))
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          args:
+            - (( concat "--password=" subst.data.database_password ))
+`,
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	return dir
+}
+
+func secretConfig(dir string) config.Configuration {
+	cfg := bundleConfig(dir)
+	cfg.FileRegex = `(subst\.yaml|.*\.ejson)`
+	cfg.SkipDecrypt = false
+	cfg.SecretSkip = true
+	cfg.Decryptors = []string{"ejson"}
+	cfg.EjsonKey = []string{"65b2f2060e6e3a976456c5a7cbcca3f15715eb1d9e0fe54174fa7b36aca1f50e"}
+	return cfg
+}
+
+func TestSecretPolicy(t *testing.T) {
+	dir := secretBundle(t)
+	build := func(policy string, allow ...string) error {
+		cfg := secretConfig(dir)
+		cfg.SecretPolicy = policy
+		cfg.SecretAllow = allow
+		b, err := New(context.Background(), cfg)
+		assert.NoError(t, err)
+		defer b.Close()
+		assert.NoError(t, b.BuildSubstitutions(context.Background()))
+		return b.Build(context.Background())
+	}
+
+	// Leaks are only logged by default
+	assert.NoError(t, build(""))
+
+	err := build(SecretPolicyStrict)
+	var located []string
+	for _, e := range utils.ErrorList(err) {
+		located = append(located, e.Resource+" "+e.Path)
+		assert.Equal(t, filepath.Join(dir, "app.yaml"), e.File)
+	}
+	assert.Equal(t, []string{
+		"ConfigMap /cm $.data.password",
+		"Deployment /app $.spec.template.spec.containers.0.args.0",
+	}, located)
+
+	assert.NoError(t, build(SecretPolicyStrict, "ConfigMap:$.data", "*:$.spec.template.spec.containers"))
+	assert.Error(t, build("invalid"))
+	assert.Error(t, build(SecretPolicyStrict, "$.data"))
+}
+
+func TestRedactSubstitutions(t *testing.T) {
+	dir := secretBundle(t)
+	write := func(reveal bool, salt string) string {
+		cfg := secretConfig(dir)
+		cfg.RevealSecrets = reveal
+		cfg.RedactSalt = salt
+		b, err := New(context.Background(), cfg)
+		assert.NoError(t, err)
+		defer b.Close()
+		assert.NoError(t, b.BuildSubstitutions(context.Background()))
+		var out bytes.Buffer
+		assert.NoError(t, b.WriteSubstitutions(&out))
+		return out.String()
+	}
+
+	redacted := write(false, "")
+	assert.NotContains(t, redacted, "VERY_SECRET")
+	assert.Contains(t, redacted, "<redacted hmac:")
+	assert.NotContains(t, redacted, utils.Redact("VERY_SECRET"))
+	assert.Contains(t, redacted, "user: admin")
+	assert.Contains(t, write(true, ""), "VERY_SECRET")
+
+	// Placeholders are keyed with the decryption keys or the salt, they are
+	// stable across builds
+	assert.Equal(t, redacted, write(false, ""))
+	salted := write(false, "salt")
+	assert.NotEqual(t, redacted, salted)
+	assert.Equal(t, salted, write(false, "salt"))
+
+	cfg := secretConfig(dir)
+	cfg.RedactSalt = "very-secret-salt"
+	assert.NotContains(t, fmt.Sprintf("%+v", cfg.Redacted()), cfg.EjsonKey[0])
+	assert.NotContains(t, fmt.Sprintf("%+v", cfg.Redacted()), cfg.RedactSalt)
+}
+
+func TestRedactError(t *testing.T) {
+	s := &Substitutions{}
+	s.taint(map[string]interface{}{"password": "VERY_SECRET"}, "secrets.ejson")
+
+	err := fmt.Errorf("failed: %w", &utils.SourceError{Path: "$.data.port", Message: `must be of type integer: "VERY_SECRET"`})
+	redacted := s.redactError(err)
+	assert.NotContains(t, redacted.Error(), "VERY_SECRET")
+	assert.Equal(t, "$.data.port: must be of type integer: \""+utils.Redact("VERY_SECRET")+"\"", redacted.Error())
+	assert.Equal(t, "$.data.port", utils.ErrorList(redacted)[0].Path)
+
+	plain := fmt.Errorf("failed")
+	assert.Same(t, plain, s.redactError(plain))
+}
+
+// Errors are redacted before they are logged
+func TestRedactLogs(t *testing.T) {
+	var logs bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&logs)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	defer func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}()
+
+	for name, manifest := range map[string]string{
+		"build":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: (( base64-decode subst.data.database_password ))\n",
+		"validate": "apiVersion: v1\nkind: Service\nmetadata:\n  name: svc\nspec:\n  ports:\n    - port: (( grab subst.data.database_password ))\n",
+	} {
+		dir := secretBundle(t)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte(manifest), 0600))
+		cfg := secretConfig(dir)
+		cfg.Validate = true
+		b, err := New(context.Background(), cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, b.BuildSubstitutions(context.Background()))
+		assert.Error(t, b.Build(context.Background()), name)
+		b.Close()
+	}
+	assert.Contains(t, logs.String(), "failed to build ConfigMap /cm")
+	assert.Contains(t, logs.String(), "invalid manifest Service /svc")
+	assert.NotContains(t, logs.String(), "VERY_SECRET")
+}
+
+func TestTaintedMinLength(t *testing.T) {
+	s := &Substitutions{}
+	s.taint(map[string]interface{}{"pin": "12345", "password": "VERY_SECRET"}, "secrets.ejson")
+
+	// Short values are only detected as whole value
+	source, ok := s.tainted("12345")
+	assert.True(t, ok)
+	assert.Equal(t, "secrets.ejson", source)
+	_, ok = s.tainted("port: 123456")
+	assert.False(t, ok)
+	_, ok = s.tainted("--password=VERY_SECRET")
+	assert.True(t, ok)
+}
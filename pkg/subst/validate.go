@@ -0,0 +1,46 @@
+package subst
+
+import (
+	"errors"
+
+	"github.com/bedag/subst/internal/validation"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// validates the manifests against the bundled Kubernetes schemas and the
+// CustomResourceDefinitions of the build and the configured directories.
+// Errors are located within the source of the resource. Manifests without
+// schema are reported as warning, unless the validation is strict.
+func (b *Build) validateManifests(resources []*resource.Resource) error {
+	v, err := validation.New()
+	if err != nil {
+		return err
+	}
+	for _, dir := range b.cfg.CRDDirs {
+		if err := v.AddCRDDir(dir); err != nil {
+			return err
+		}
+	}
+
+	manifests := make([]map[string]interface{}, len(b.Manifests))
+	for i, manifest := range b.Manifests {
+		manifests[i] = jsonValue(manifest).(map[string]interface{})
+		if err := v.AddCRD(manifests[i]); err != nil {
+			return b.locateManifestError(err, resourceID(resources[i]), resources[i])
+		}
+	}
+
+	var errs []error
+	for i, manifest := range manifests {
+		err := v.Validate(manifest)
+		if errors.Is(err, validation.ErrNoSchema) && !b.cfg.ValidateStrict {
+			b.log.Warn().Msgf("%s not validated: %s", resourceID(resources[i]), err)
+			continue
+		}
+		if err != nil {
+			b.log.Debug().Msgf("invalid manifest %s: %s", resourceID(resources[i]), b.Substitutions.redactError(err))
+			errs = append(errs, b.locateManifestError(err, resourceID(resources[i]), resources[i]))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,182 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/validation"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: %[1]ss.example.com
+spec:
+  group: example.com
+  names:
+    kind: %[1]s
+    plural: %[1]ss
+  scope: Namespaced
+  versions:
+    - name: v1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [size]
+              properties:
+                size:
+                  type: integer
+                port:
+                  x-kubernetes-int-or-string: true
+`
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	crds := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml": "resources:\n  - deployment.yaml\n  - crd.yaml\n  - custom.yaml\n",
+		"subst.yaml":         "port: \"80\"\nreplicas: 2\n",
+		"deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+spec:
+  replicas: (( grab subst.replicas ))
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+        - name: app
+          image: nginx
+          resources:
+            limits:
+              cpu: 1
+          ports:
+            - containerPort: (( grab subst.port ))
+`,
+		"crd.yaml": sprintf(testCRD, "Bucket"),
+		"custom.yaml": `apiVersion: example.com/v1
+kind: Bucket
+metadata:
+  name: bucket
+spec:
+  size: large
+  port: 80
+---
+apiVersion: example.com/v1
+kind: Queue
+metadata:
+  name: queue
+spec:
+  port: http
+---
+apiVersion: example.com/v1
+kind: Unknown
+metadata:
+  name: unknown
+spec:
+  size: large
+`,
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(crds, "queue.yaml"), []byte(sprintf(testCRD, "Queue")), 0600))
+
+	cfg := bundleConfig(dir)
+	cfg.Validate = true
+	cfg.CRDDirs = []string{crds}
+	b, err := New(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, b.BuildSubstitutions(context.Background()))
+	err = b.Build(context.Background())
+	assert.Error(t, err)
+
+	var located []string
+	for _, e := range utils.ErrorList(err) {
+		located = append(located, filepath.Base(e.File)+" "+e.Resource+" "+e.Path)
+		assert.NotZero(t, e.Line, e.Error())
+	}
+	assert.ElementsMatch(t, []string{
+		"deployment.yaml Deployment /app $.spec.template.spec.containers.0.ports.0.containerPort",
+		"custom.yaml Bucket /bucket $.spec.size",
+		"custom.yaml Queue /queue $.spec.size",
+	}, located)
+
+	// Manifests without schema fail strict validations
+	cfg.ValidateStrict = true
+	b, err = New(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, b.BuildSubstitutions(context.Background()))
+	err = b.Build(context.Background())
+	assert.ErrorIs(t, err, validation.ErrNoSchema)
+	assert.Len(t, utils.ErrorList(err), 4)
+	assert.Contains(t, err.Error(), "no schema for example.com/v1 Unknown")
+}
+
+func sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...)
+}
+
+func TestValidateNoSchema(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = logger }()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml": "resources:\n  - custom.yaml\n",
+		"custom.yaml":        "apiVersion: example.com/v1\nkind: Unknown\nmetadata:\n  name: unknown\n",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+
+	tests := []struct {
+		name   string
+		strict bool
+	}{
+		{name: "warn"},
+		{name: "strict", strict: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			cfg := bundleConfig(dir)
+			cfg.Validate = true
+			cfg.ValidateStrict = tt.strict
+			b, err := New(context.Background(), cfg)
+			assert.NoError(t, err)
+			assert.NoError(t, b.BuildSubstitutions(context.Background()))
+			err = b.Build(context.Background())
+			if tt.strict {
+				assert.ErrorIs(t, err, validation.ErrNoSchema)
+				assert.NotContains(t, logs.String(), "not validated")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, b.Manifests, 1)
+			assert.Contains(t, logs.String(), "Unknown /unknown not validated: no schema for example.com/v1 Unknown")
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package subst
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/bedag/subst/internal/utils"
+)
+
+const (
+	vaultField = "substVault"
+)
+
+// Matches a spruce vault operator with a single literal reference
+var vaultOperatorRegex = regexp.MustCompile(`^\(\(\s*vault\s+"([^"]+)"\s*\)\)$`)
+
+// resolves vault references within a substitution file:
+//   - a `substVault:` block maps substitution keys to vault references, the
+//     resolved values are added as top level substitutions
+//   - `(( vault "<reference>" ))` operators are replaced with their value
+//
+// Without a configured vault client, operators are left to spruce
+func (s *Substitutions) resolveVault(ctx context.Context, data map[interface{}]interface{}) error {
+	if block, ok := data[vaultField]; ok {
+		refs, ok := block.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a map of substitution keys to vault references", vaultField)
+		}
+		if s.vault == nil {
+			return fmt.Errorf("found %s block, but vault is not configured (see --vault-addr)", vaultField)
+		}
+		delete(data, vaultField)
+		for key, ref := range refs {
+			r, ok := ref.(string)
+			if !ok {
+				return fmt.Errorf("vault reference for %v must be a string", key)
+			}
+			value, err := s.resolveVaultRef(ctx, r)
+			if err != nil {
+				return err
+			}
+			data[key] = normalize(value)
+		}
+	}
+
+	if s.vault == nil {
+		return nil
+	}
+	_, err := s.resolveVaultOperators(ctx, data)
+	return err
+}
+
+// resolves a single vault reference, sandboxed files may only reference the
+// allowed paths. The values are tracked like decrypted values.
+func (s *Substitutions) resolveVaultRef(ctx context.Context, ref string) (interface{}, error) {
+	if s.sandbox != nil && !s.sandbox.vaultAllowed(ref) {
+		return nil, fmt.Errorf("vault reference %q is not allowed (see --allow-vault-path)", ref)
+	}
+	value, err := s.vault.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	s.taint(value, "vault "+ref)
+	return value, nil
+}
+
+// converts maps to the representation used by spruce
+func normalize(value interface{}) interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		return utils.ToInterfaceDeep(m)
+	}
+	return value
+}
+
+// replaces vault operators in the tree (recursive)
+func (s *Substitutions) resolveVaultOperators(ctx context.Context, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			r, err := s.resolveVaultOperators(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	case []interface{}:
+		for i, item := range v {
+			r, err := s.resolveVaultOperators(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	case string:
+		if m := vaultOperatorRegex.FindStringSubmatch(v); m != nil {
+			value, err := s.resolveVaultRef(ctx, m[1])
+			if err != nil {
+				return nil, err
+			}
+			return normalize(value), nil
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,60 @@
+package subst
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bedag/subst/internal/vault"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"data":     map[string]interface{}{"password": "s3cr3t"},
+			"metadata": map[string]interface{}{},
+		}})
+	}))
+	defer server.Close()
+
+	client, err := vault.New(vault.Config{Address: server.URL, Token: "root"})
+	assert.NoError(t, err)
+	s := &Substitutions{vault: client}
+
+	data := map[interface{}]interface{}{
+		"substVault": map[interface{}]interface{}{"db_password": "secret/data/app:password"},
+		"app": map[interface{}]interface{}{
+			"password": `(( vault "secret/data/app:password" ))`,
+			"other":    `(( grab subst.app.password ))`,
+		},
+	}
+	assert.NoError(t, s.resolveVault(context.Background(), data))
+	assert.Equal(t, map[interface{}]interface{}{
+		"db_password": "s3cr3t",
+		"app": map[interface{}]interface{}{
+			"password": "s3cr3t",
+			"other":    `(( grab subst.app.password ))`,
+		},
+	}, data)
+	source, ok := s.tainted("s3cr3t")
+	assert.True(t, ok)
+	assert.Equal(t, "vault secret/data/app:password", source)
+
+	// Without vault configuration the block can not be resolved
+	err = (&Substitutions{}).resolveVault(context.Background(), map[interface{}]interface{}{
+		"substVault": map[interface{}]interface{}{"db_password": "secret/data/app:password"},
+	})
+	assert.Error(t, err)
+
+	// Sandboxed files may only reference the allowed paths
+	s.sandbox = &sandbox{vaultPaths: []string{"secret/data/app"}}
+	assert.NoError(t, s.resolveVault(context.Background(), map[interface{}]interface{}{
+		"password": `(( vault "secret/data/app:password" ))`,
+	}))
+	assert.Error(t, s.resolveVault(context.Background(), map[interface{}]interface{}{
+		"password": `(( vault "secret/data/application:password" ))`,
+	}))
+}
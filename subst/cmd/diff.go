@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/bedag/subst/internal/diff"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+)
+
+func newDiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Show the rendered difference between two directories or revisions",
+		Long: heredoc.Doc(`
+			Run 'subst diff' to render two kustomizations and compare the resulting resources.
+			Resources are matched by apiVersion, kind, namespace and name and compared field by field.
+			With --live the rendered resources are compared against their state in the cluster.
+			Values of Secrets are redacted, see --reveal-secrets.`),
+		Example: `# Compare two directories
+subst diff clusters/cluster-01 clusters/cluster-02
+# Compare the current directory with the state of the main branch
+subst diff --git-ref main .
+# Compare the current directory with the live state in the cluster
+subst diff --live .`,
+		Args: cobra.RangeArgs(0, 2),
+		RunE: diffCmd,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	addDiffFlags(flags)
+	addRevealFlag(flags)
+	return cmd
+}
+
+func addDiffFlags(flags *flag.FlagSet) {
+	flags.String("git-ref", "", heredoc.Doc(`
+			Compare the given directory against the state of this git reference`))
+	flags.Bool("live", false, heredoc.Doc(`
+			Compare the given directory against the live state of the resources in the cluster`))
+}
+
+func diffCmd(cmd *cobra.Command, args []string) error {
+	ref, _ := cmd.Flags().GetString("git-ref")
+	live, _ := cmd.Flags().GetBool("live")
+	reveal, _ := cmd.Flags().GetBool("reveal-secrets")
+
+	if live {
+		if ref != "" || len(args) > 1 {
+			return fmt.Errorf("only one directory can be given with --live")
+		}
+		return diffLive(cmd, args, reveal)
+	}
+
+	var from, to string
+	if ref != "" {
+		if len(args) > 1 {
+			return fmt.Errorf("only one directory can be given with --git-ref")
+		}
+		dir, err := rootDirectory(args)
+		if err != nil {
+			return err
+		}
+		worktree, cleanup, err := gitWorktree(dir, ref)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		from, to = worktree, dir
+	} else {
+		if len(args) != 2 {
+			return fmt.Errorf("two directories must be given (or use --git-ref)")
+		}
+		a, err := rootDirectory(args[:1])
+		if err != nil {
+			return err
+		}
+		b, err := rootDirectory(args[1:])
+		if err != nil {
+			return err
+		}
+		from, to = a, b
+	}
+
+	fromBuild, _, err := renderDirectory(cmd, from)
+	if err != nil {
+		return fmt.Errorf("failed rendering %s: %w", from, err)
+	}
+	toBuild, _, err := renderDirectory(cmd, to)
+	if err != nil {
+		return fmt.Errorf("failed rendering %s: %w", to, err)
+	}
+
+	diffs := diff.Resources(fromBuild.Manifests, toBuild.Manifests, diff.Options{RevealSecrets: reveal})
+	return diff.Print(cmd.OutOrStdout(), diffs)
+}
+
+// compares the rendered directory against the cluster
+func diffLive(cmd *cobra.Command, args []string, reveal bool) error {
+	dir, err := rootDirectory(args)
+	if err != nil {
+		return err
+	}
+	m, configuration, err := renderDirectory(cmd, dir)
+	if err != nil {
+		return err
+	}
+
+	client, err := m.LiveResources()
+	if err != nil {
+		return err
+	}
+	live, rendered, err := diff.Live(cmd.Context(), client, m.Manifests, configuration.KubectlTimeout)
+	if err != nil {
+		return err
+	}
+
+	diffs := diff.Resources(live, rendered, diff.LiveOptions(reveal))
+	return diff.Print(cmd.OutOrStdout(), diffs)
+}
+
+// runs the full build for the given directory, revealing secret values is
+// logged for auditing
+func renderDirectory(cmd *cobra.Command, dir string) (*subst.Build, *config.Configuration, error) {
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed loading configuration: %w", err)
+	}
+	m, err := subst.New(cmd.Context(), *configuration)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer m.Close()
+	if err = m.BuildSubstitutions(cmd.Context()); err != nil {
+		return nil, nil, err
+	}
+	if err = m.Build(cmd.Context()); err != nil {
+		return nil, nil, err
+	}
+	if configuration.RevealSecrets {
+		m.AuditReveal()
+	}
+	return m, configuration, nil
+}
+
+// checks out the given reference into a temporary worktree and returns the
+// path of the directory within the worktree
+func gitWorktree(dir string, ref string) (path string, cleanup func(), err error) {
+	top, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	rel, err := filepath.Rel(top, resolved)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "subst-diff-")
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = git(top, "worktree", "add", "--detach", tmp, ref); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", nil, err
+	}
+	log.Debug().Msgf("checked out %s to %s", ref, tmp)
+
+	cleanup = func() {
+		if _, err := git(top, "worktree", "remove", "--force", tmp); err != nil {
+			log.Warn().Msgf("failed to remove worktree %s: %s", tmp, err)
+		}
+		_ = os.RemoveAll(tmp)
+	}
+	return filepath.Join(tmp, rel), cleanup, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	c := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s: %w", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/spf13/cobra"
+)
+
+func newLintCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Lint the substitution files",
+		Long: heredoc.Doc(`
+			Run 'subst lint' to check the substitution files of the kustomization paths: files which can't be parsed,
+			resources without apiVersion or kind, unencrypted values in ejson files, ejson files without loaded private
+			key, references to undefined substitutions and substitutions which are never referenced (warning).
+			Fails if errors are found.`),
+		Example: `# Lint a cluster in CI
+subst lint --format json examples/02-overlays/clusters/cluster-01`,
+		RunE: lint,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	flags.String("format", "text", heredoc.Doc(`
+			Format of the findings. One of: text, json`))
+	return cmd
+}
+
+func lint(cmd *cobra.Command, args []string) error {
+	format, _ := cmd.Flags().GetString("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %q (supported: text, json)", format)
+	}
+
+	dir, err := rootDirectory(args)
+	if err != nil {
+		return err
+	}
+
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+	m, err := subst.New(cmd.Context(), *configuration)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	findings, err := m.Lint(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, f := range findings {
+		failed = failed || f.Severity == subst.SeverityError
+	}
+	if format == "json" {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if findings == nil {
+			findings = []subst.Finding{}
+		}
+		if err := out.Encode(map[string]interface{}{"findings": findings}); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+	}
+
+	// The findings are the output, they are not printed again as error
+	if failed {
+		cmd.SilenceErrors = true
+		return errSilent
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+func newParametersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "parameters",
+		Short: "Print the parameters announcement for Argo CD",
+		Long: heredoc.Doc(`
+			Run 'subst parameters' to print the parameters announcement of the Argo CD config management plugin
+			(parameters.dynamic.command). Argo CD passes the values as PARAM_<NAME> environment variables (arrays as
+			PARAM_<NAME>_<INDEX>), which are read by 'subst render'. Flags given on the command line take precedence.`),
+		Args: cobra.ArbitraryArgs,
+		RunE: parameters,
+	}
+
+	// The defaults of the announcement are taken from the render flags
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	return cmd
+}
+
+func parameters(cmd *cobra.Command, args []string) error {
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.SetEscapeHTML(false)
+	return out.Encode(config.Parameters(cmd.Flags()))
+}
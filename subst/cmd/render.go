@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/MakeNowJust/heredoc"
-	"github.com/bedag/subst/internal/utils"
+	"github.com/bedag/subst/internal/cache"
 	"github.com/bedag/subst/pkg/config"
 	"github.com/bedag/subst/pkg/subst"
 	"github.com/rs/zerolog/log"
@@ -29,6 +31,24 @@ subst render ../examples/02-overlays/clusters/cluster-01`,
 	flags := cmd.Flags()
 	addCommonFlags(flags)
 	addRenderFlags(flags)
+	flags.String("cache-dir", "", heredoc.Doc(`
+			Cache rendered output in the given directory, keyed by the content of the inputs.
+			Entries are encrypted with a key derived from the decryption keys`))
+	flags.Bool("validate", false, heredoc.Doc(`
+			Validate the rendered manifests against the bundled Kubernetes OpenAPI schemas and the
+			CustomResourceDefinitions of the build (see --crd-dir). Works offline, manifests of unknown kinds are not validated`))
+	flags.Bool("validate-strict", false, heredoc.Doc(`
+			Fail the validation (see --validate) for manifests of unknown kinds (eg. custom resources without
+			CustomResourceDefinition or a typo in the apiVersion) instead of warning`))
+	flags.StringSlice("crd-dir", []string{}, heredoc.Doc(`
+			Directory with CustomResourceDefinitions (YAML or JSON) to validate custom resources with (see --validate).
+			May be specified multiple times`))
+	flags.String("secret-policy", "warn", heredoc.Doc(`
+			Policy for decrypted values outside of Secret data and stringData (eg. grabbed into a ConfigMap or container args).
+			One of: warn, strict (fail the render)`))
+	flags.StringSlice("secret-allow", []string{}, heredoc.Doc(`
+			Field which may contain decrypted values (<kind>:<path>, eg. Deployment:$.spec.template.spec.containers.0.args).
+			The kind * matches all kinds. May be specified multiple times`))
 	return cmd
 }
 
@@ -39,6 +59,9 @@ func addRenderFlags(flags *flag.FlagSet) {
 	if flags.Lookup("kube-api") == nil {
 		flags.String("kube-api", "", "Kubernetes API Url")
 	}
+	if flags.Lookup("kubectl-timeout") == nil {
+		flags.Duration("kubectl-timeout", 30*time.Second, "Timeout for each request to the Kubernetes API (0 disables the timeout)")
+	}
 	flags.Bool("convert-secret-name", true, heredoc.Doc(`
 			Assuming the secret name is derived from ARGOCD_APP_NAME, this option will only use the application name (without project-name_)`))
 	flags.Bool("skip-secret-lookup", false, heredoc.Doc(`
@@ -47,15 +70,54 @@ func addRenderFlags(flags *flag.FlagSet) {
 	        Specify Secret name (each key within the secret will be used as a decryption key)`))
 	flags.String("secret-namespace", "", heredoc.Doc(`
 	        Specify Secret namespace`))
+	flags.StringSlice("secret", []string{}, heredoc.Doc(`
+			Additional Secret ([<namespace>/]<name>) to read decryption keys from, defaults to the Secret namespace.
+			May be specified multiple times, Secrets are read in the given order`))
+	flags.String("secret-selector", "", heredoc.Doc(`
+			Label selector for additional Secrets in the Secret namespace to read decryption keys from (eg. for shared keys)`))
+	flags.Bool("require-secret", false, heredoc.Doc(`
+			Fail if decryption keys can not be read from a Secret (eg. the Secret is missing or access is denied),
+			instead of continuing without its keys`))
 	flags.StringSlice("ejson-key", []string{}, heredoc.Doc(`
 			Specify EJSON Private key used for decryption.
 			May be specified multiple times or separate values with commas`))
+	flags.StringArray("key-source", []string{}, heredoc.Doc(`
+			Additional source for decryption keys. One of: file:<path>, env:<variable>, exec:<command>.
+			Files may be a single key file or a directory of key files.
+			May be specified multiple times`))
+	flags.StringArray("decryptor", []string{"ejson"}, heredoc.Doc(`
+			Decryptor backends to use, in the order they are probed. Format: <name>[=<argument>].
+			Available: ejson[=<key-directory>], exec=<command>.
+			May be specified multiple times`))
 	flags.Bool("skip-decrypt", false, heredoc.Doc(`
 			Skip decryption`))
+	flags.String("redact-salt", "", heredoc.Doc(`
+			Secret salt of the placeholders of redacted values, so placeholders are comparable across runs
+			(default: derived from the loaded decryption keys, random without keys)`))
+	flags.Bool("skip-schema", false, heredoc.Doc(`
+			Skip the validation of the substitutions against subst.schema.yaml files`))
 	flags.String("env-regex", "^ARGOCD_ENV_.*$", heredoc.Doc(`
 	        Only expose environment variables that match the given regex`))
 	flags.String("output", "yaml", heredoc.Doc(`
 	        Output format. One of: yaml, json`))
+	flags.StringSlice("subst-from-configmap", []string{}, heredoc.Doc(`
+			Add the data of a ConfigMap (<namespace>/<name>) as substitutions.
+			May be specified multiple times`))
+	flags.StringSlice("subst-from-secret", []string{}, heredoc.Doc(`
+			Add the data of a Secret (<namespace>/<name>) as substitutions.
+			May be specified multiple times`))
+	flags.String("subst-from-precedence", "low", heredoc.Doc(`
+			Precedence of ConfigMap and Secret substitutions. One of: low (substitution files overwrite them), high (they overwrite substitution files)`))
+	flags.String("vault-addr", "", heredoc.Doc(`
+			Vault/OpenBao address used to resolve vault references in substitution files`))
+	flags.String("vault-namespace", "", heredoc.Doc(`
+			Vault namespace`))
+	flags.String("vault-auth", "token", heredoc.Doc(`
+			Vault auth method. One of: token ($VAULT_TOKEN), approle ($VAULT_ROLE_ID, $VAULT_SECRET_ID), kubernetes`))
+	flags.String("vault-auth-mount", "", heredoc.Doc(`
+			Mount path of the vault auth method (default: name of the auth method)`))
+	flags.String("vault-role", "", heredoc.Doc(`
+			Vault role for kubernetes authentication`))
 
 }
 
@@ -71,35 +133,59 @@ func render(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed loading configuration: %w", err)
 	}
-	m, err := subst.New(*configuration)
+	m, err := subst.New(cmd.Context(), *configuration)
 	if err != nil {
 		return err
 	}
+	defer m.Close()
 
-	err = m.BuildSubstitutions()
-	if err != nil {
-		return err
+	// Substitutions from Vault or the cluster are not covered by the cache
+	// key, the key initializes the decryptors Cacheable depends on
+	var entries *cache.Cache
+	var key string
+	var secret []byte
+	if configuration.CacheDir != "" {
+		key, secret, err = m.CacheKey(cmd.Context())
+		if err != nil {
+			return err
+		}
 	}
-
-	if m != nil {
-		err = m.Build()
+	if configuration.CacheDir != "" && m.Cacheable() {
+		entries, err = cache.New(configuration.CacheDir)
 		if err != nil {
 			return err
 		}
-		if m.Manifests != nil {
-			for _, f := range m.Manifests {
-				if configuration.Output == "json" {
-					err = utils.PrintJSON(f)
-					if err != nil {
-						log.Error().Msgf("failed to print JSON: %s", err)
-					}
-				} else {
-					err = utils.PrintYAML(f)
-					if err != nil {
-						log.Error().Msgf("failed to print JSON: %s", err)
-					}
-				}
-			}
+		cached, hit, err := entries.Get(key, secret)
+		if err != nil {
+			log.Warn().Msgf("failed to read cache entry: %s", err)
+		} else if hit {
+			log.Debug().Msgf("using cached render %s", key)
+			_, err = os.Stdout.Write(cached)
+			return err
+		}
+	}
+
+	err = m.BuildSubstitutions(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	err = m.Build(cmd.Context())
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	err = m.Write(&out)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stdout.Write(out.Bytes()); err != nil {
+		return err
+	}
+
+	if entries != nil && m.Cacheable() {
+		if err := entries.Put(key, secret, out.Bytes()); err != nil {
+			log.Warn().Msgf("failed to write cache entry: %s", err)
 		}
 	}
 	elapsed := time.Since(start) // Calculate elapsed time
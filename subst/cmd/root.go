@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"strconv"
 	"sync"
+	"syscall"
 
+	"github.com/bedag/subst/internal/utils"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	flag "github.com/spf13/pflag"
@@ -26,8 +32,12 @@ var (
 	memProfile     bool
 	cpuProfileFile string
 	memProfileFile string
+	errorFormat    string
 )
 
+// errSilent fails a command which already reported the failure in its output
+var errSilent = errors.New("failed")
+
 func NewRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "subst",
@@ -43,6 +53,9 @@ func NewRootCmd() *cobra.Command {
 		if err := setUpLogs(v); err != nil {
 			return err
 		}
+		if err := setUpErrorFormat(cmd.Root()); err != nil {
+			return err
+		}
 		if err := setUpMaxProcs(p); err != nil {
 			return err
 		}
@@ -56,6 +69,8 @@ func NewRootCmd() *cobra.Command {
 	//Default value is inferred from cgroups or system
 	cmd.PersistentFlags().IntVarP(&p, "maxprocs", "p", 0, "Overwrite GOMAXPROCS for the command to use (default: 0 which means respect cgroup or system)")
 
+	cmd.PersistentFlags().StringVar(&errorFormat, "error-format", "text", "Format of returned errors. One of: text, json (eg. for CI annotations)")
+
 	cmd.PersistentFlags().BoolVar(&cpuProfile, "cpu-profile", false, "write cpu profile to file")
 	cmd.PersistentFlags().BoolVar(&memProfile, "mem-profile", false, "write memory profile to file")
 
@@ -67,6 +82,11 @@ func NewRootCmd() *cobra.Command {
 	cmd.AddCommand(newGenerateDocsCmd())
 	cmd.AddCommand(newRenderCmd())
 	cmd.AddCommand(newSubstitutionsCmd())
+	cmd.AddCommand(newDiffCmd())
+	cmd.AddCommand(newServeCmd())
+	cmd.AddCommand(newParametersCmd())
+	cmd.AddCommand(newSchemaCmd())
+	cmd.AddCommand(newLintCmd())
 	//
 
 	cmd.DisableAutoGenTag = true
@@ -77,12 +97,45 @@ func NewRootCmd() *cobra.Command {
 // Execute runs the application
 func Execute() {
 	defer stopProfiling()
-	if err := NewRootCmd().Execute(); err != nil {
-		fmt.Println(err)
+	// Builds are canceled on SIGTERM (eg. by the Argo CD exec timeout)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := NewRootCmd().ExecuteContext(ctx); err != nil {
+		switch {
+		case errors.Is(err, errSilent):
+		case errorFormat == "json":
+			printErrorsJSON(err)
+		default:
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
 }
 
+// errors are printed as json by Execute, cobra must not print them
+func setUpErrorFormat(root *cobra.Command) error {
+	switch errorFormat {
+	case "text":
+	case "json":
+		root.SilenceErrors = true
+	default:
+		return fmt.Errorf("invalid error format %q (supported: text, json)", errorFormat)
+	}
+	return nil
+}
+
+// prints the errors as json to stderr:
+//
+//	{"errors": [{"file": "...", "line": 3, "column": 5, "resource": "...", "path": "$.spec", "message": "..."}]}
+func printErrorsJSON(err error) {
+	out, jsonErr := json.Marshal(map[string]interface{}{"errors": utils.ErrorList(err)})
+	if jsonErr != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(out))
+}
+
 // setUpLogs set the log output ans the log level
 func setUpLogs(level string) error {
 	lvl, err := zerolog.ParseLevel(level)
@@ -190,6 +243,13 @@ func addCommonFlags(flags *flag.FlagSet) {
 			expose sensitive data)`))
 }
 
+// adds the flag to reveal secret values in the output of a command
+func addRevealFlag(flags *flag.FlagSet) {
+	flags.Bool("reveal-secrets", false, heredoc.Doc(`
+			Show secret values instead of redacted placeholders (<redacted hmac:<hash>>).
+			Revealing is logged for auditing`))
+}
+
 func rootDirectory(args []string) (directory string, err error) {
 	directory = "."
 	if len(args) > 0 {
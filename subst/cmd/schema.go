@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/spf13/cobra"
+)
+
+func newSchemaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Manage the JSON Schema of the substitutions",
+		Long: heredoc.Doc(`
+			Substitutions are validated against the JSON Schema of each subst.schema.yaml file within the
+			kustomization paths (see --skip-schema).`),
+	}
+	cmd.AddCommand(newSchemaInferCmd())
+	return cmd
+}
+
+func newSchemaInferCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "infer",
+		Short: "Infer a JSON Schema from the substitutions",
+		Long: heredoc.Doc(`
+			Run 'subst schema infer' to print a JSON Schema inferred from the available substitutions, which may be
+			used as subst.schema.yaml. All keys are required, existing schemas are not validated.`),
+		Example: `# Bootstrap the schema of a cluster
+subst schema infer examples/02-overlays/clusters/cluster-01 > examples/02-overlays/clusters/cluster-01/subst.schema.yaml`,
+		RunE: schemaInfer,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	return cmd
+}
+
+func schemaInfer(cmd *cobra.Command, args []string) error {
+	dir, err := rootDirectory(args)
+	if err != nil {
+		return err
+	}
+
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+	configuration.SkipSchema = true
+	m, err := subst.New(cmd.Context(), *configuration)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	err = m.BuildSubstitutions(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return m.WriteSchema(os.Stdout)
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/bedag/subst/internal/kube"
+	"github.com/bedag/subst/internal/server"
+	"github.com/bedag/subst/pkg/config"
+	"github.com/bedag/subst/pkg/subst"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+)
+
+func newServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve renders over HTTP",
+		Long: heredoc.Doc(`
+			Run 'subst serve' to render applications over HTTP (eg. in-cluster, next to Argo CD).
+			Applications are uploaded as tar.gz archive with a multipart/form-data request:
+
+			  POST /render                      rendered manifests
+			  POST /substitutions               available substitutions
+			  POST /api/v1/getparams.execute    ApplicationSet plugin generator (with --generator-root)
+			  GET  /healthz                     health check
+			  GET  /metrics                     metrics in the Prometheus text format
+
+			Form fields: archive (tar.gz of the application), path (directory within the archive),
+			env (JSON object of environment variables matching --env-regex), output (yaml, json),
+			app (name of the Argo CD application, required with --app-secret-namespace).
+			Decryption keys are read from the Secret of the application in --app-secret-namespace (or from the
+			Secrets configured for the server without it) and cached between requests.
+
+			Requests require the bearer token (--token-file) or a client certificate signed by --tls-client-ca-file.
+			Uploads are confined to the archive: kustomize only loads files within their kustomization root and
+			builtin plugins, substFrom blocks and vault references of substitution files are rejected unless
+			allowed (--allow-subst-from, --allow-vault-path).
+
+			The ApplicationSet plugin generator returns one parameter set per kustomization directory matching
+			the path glob within the generator root, with the selected substitution keys.`),
+		Example: `# Serve on port 8080
+subst serve --listen :8080 --token-file /etc/subst/token
+# Render an application
+tar -czf app.tar.gz -C examples/02-overlays . && curl -H "Authorization: Bearer $(cat /etc/subst/token)" -F archive=@app.tar.gz -F path=clusters/cluster-01 http://localhost:8080/render`,
+		Args: cobra.NoArgs,
+		RunE: serve,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	flags.String("listen", ":8080", heredoc.Doc(`
+			Address to listen on`))
+	flags.Duration("key-cache-ttl", 5*time.Minute, heredoc.Doc(`
+			Duration decryption keys read from Secrets are cached`))
+	flags.Int64("max-archive-size", server.DefaultMaxArchiveSize, heredoc.Doc(`
+			Maximum size of uploaded archives in bytes`))
+	flags.Int64("max-extracted-size", server.DefaultMaxExtractedSize, heredoc.Doc(`
+			Maximum size of the files extracted from an archive in bytes`))
+	flags.String("generator-root", "", heredoc.Doc(`
+			Directory (eg. a repository checkout) of the ApplicationSet plugin generator. The generator is disabled if empty`))
+	flags.String("generator-token-file", "", heredoc.Doc(`
+			File with the token of the ApplicationSet plugin generator (the token of the plugin ConfigMap),
+			defaults to the token of --token-file`))
+	flags.String("token-file", "", heredoc.Doc(`
+			File with the bearer token of the requests`))
+	flags.String("tls-cert-file", "", heredoc.Doc(`
+			File with the TLS certificate of the server, serves plain HTTP if empty`))
+	flags.String("tls-key-file", "", heredoc.Doc(`
+			File with the private key of the TLS certificate`))
+	flags.String("tls-client-ca-file", "", heredoc.Doc(`
+			File with the CA certificates of the clients (mTLS), requests with a verified client certificate do not
+			require the token`))
+	flags.String("app-secret-namespace", "", heredoc.Doc(`
+			Namespace of the Secrets of the applications. Requests must name their application (app), the keys are
+			read from its Secret in this namespace (named like the Secret derived from ARGOCD_APP_NAME) instead of
+			the Secrets configured for the server`))
+	flags.StringSlice("allow-subst-from", []string{}, heredoc.Doc(`
+			Source uploaded substitution files may read with substFrom (<kind>:<namespace>/<name>, the name may be a glob,
+			eg. configMap:kube-system/cluster-facts). May be specified multiple times`))
+	flags.StringSlice("allow-vault-path", []string{}, heredoc.Doc(`
+			Vault path (and its children) uploaded substitution files may reference (eg. secret/data/apps).
+			May be specified multiple times`))
+	return cmd
+}
+
+func serve(cmd *cobra.Command, args []string) error {
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, "")
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+	flags := cmd.Flags()
+	listen, _ := flags.GetString("listen")
+	ttl, _ := flags.GetDuration("key-cache-ttl")
+	maxArchiveSize, _ := flags.GetInt64("max-archive-size")
+	maxExtractedSize, _ := flags.GetInt64("max-extracted-size")
+	generatorRoot, _ := flags.GetString("generator-root")
+	generatorTokenFile, _ := flags.GetString("generator-token-file")
+	tokenFile, _ := flags.GetString("token-file")
+	certFile, _ := flags.GetString("tls-cert-file")
+	keyFile, _ := flags.GetString("tls-key-file")
+	clientCAFile, _ := flags.GetString("tls-client-ca-file")
+	appSecretNamespace, _ := flags.GetString("app-secret-namespace")
+
+	if tokenFile == "" && clientCAFile == "" {
+		return fmt.Errorf("requests must be authenticated, set --token-file or --tls-client-ca-file")
+	}
+	if clientCAFile != "" && certFile == "" {
+		return fmt.Errorf("--tls-client-ca-file requires --tls-cert-file")
+	}
+	token, err := readToken(tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed reading token: %w", err)
+	}
+	if tokenFile != "" && token == "" {
+		return fmt.Errorf("token file %s is empty", tokenFile)
+	}
+
+	var generatorToken string
+	if generatorRoot != "" {
+		if generatorRoot, err = filepath.Abs(generatorRoot); err != nil {
+			return fmt.Errorf("failed resolving generator root: %w", err)
+		}
+		if generatorToken, err = readToken(generatorTokenFile); err != nil {
+			return fmt.Errorf("failed reading generator token: %w", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		// Clients without certificate may authenticate with the token
+		tlsConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	// A single client is shared by all renders, it is created for each
+	// render if the cluster is not reachable at startup
+	var client kubernetes.Interface
+	restConfig, err := kube.Config(configuration.Kubeconfig, configuration.KubeAPI)
+	if err == nil {
+		client, err = kubernetes.NewForConfig(restConfig)
+	}
+	if err != nil {
+		log.Warn().Msgf("failed to create kubernetes client: %s", err)
+		client = nil
+	}
+
+	keys := subst.NewKeyCache(ttl)
+	defer keys.Purge()
+
+	srv := &http.Server{
+		Addr: listen,
+		Handler: server.New(server.Config{
+			Configuration:      *configuration,
+			MaxArchiveSize:     maxArchiveSize,
+			MaxExtractedSize:   maxExtractedSize,
+			GeneratorRoot:      generatorRoot,
+			GeneratorToken:     generatorToken,
+			Token:              token,
+			AppSecretNamespace: appSecretNamespace,
+		}, keys, client).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Info().Msgf("listening on %s", listen)
+		if certFile != "" {
+			errs <- srv.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-cmd.Context().Done():
+		log.Info().Msg("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// reads the token of the file, empty if no file is given
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	token, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
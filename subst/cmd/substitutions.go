@@ -2,10 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/MakeNowJust/heredoc"
-	"github.com/bedag/subst/internal/utils"
 	"github.com/bedag/subst/pkg/config"
 	"github.com/bedag/subst/pkg/subst"
 	"github.com/rs/zerolog/log"
@@ -17,13 +17,15 @@ func newSubstitutionsCmd() *cobra.Command {
 		Use:   "substitutions",
 		Short: "Render available substitutions",
 		Long: heredoc.Doc(`
-			Run 'subst substitutions' to return available substitutions for given Kustomize.`),
+			Run 'subst substitutions' to return available substitutions for given Kustomize. Decrypted values are
+			redacted, see --reveal-secrets.`),
 		RunE: substitutions,
 	}
 
 	flags := cmd.Flags()
 	addCommonFlags(flags)
 	addRenderFlags(flags)
+	addRevealFlag(flags)
 	return cmd
 
 }
@@ -40,30 +42,20 @@ func substitutions(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed loading configuration: %w", err)
 	}
-	m, err := subst.New(*configuration)
+	m, err := subst.New(cmd.Context(), *configuration)
 	if err != nil {
 		return err
 	}
+	defer m.Close()
 
-	err = m.BuildSubstitutions()
+	err = m.BuildSubstitutions(cmd.Context())
 	if err != nil {
 		return err
 	}
 
-	if m != nil {
-		if len(m.Substitutions.Subst) > 0 {
-			if configuration.Output == "json" {
-				err = utils.PrintJSON(m.Substitutions.Subst)
-				if err != nil {
-					log.Error().Msgf("failed to print JSON: %s", err)
-				}
-			} else {
-				err = utils.PrintYAML(m.Substitutions.Subst)
-				if err != nil {
-					log.Error().Msgf("failed to print JSON: %s", err)
-				}
-			}
-		}
+	err = m.WriteSubstitutions(os.Stdout)
+	if err != nil {
+		return err
 	}
 	elapsed := time.Since(start) // Calculate elapsed time
 	log.Debug().Msgf("Build time for substitutions: %s", elapsed)